@@ -1,8 +1,8 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"errors"
+	"log"
 	"slices"
 	"strconv"
 	"time"
@@ -10,22 +10,32 @@ import (
 	"stmsh/pkg/ws"
 )
 
+const (
+	// maxPlayerNameLength is in characters, the max of MessageJoin.Name
+	maxPlayerNameLength = 64
+	// defaultPlayerName is for players who never picked a name, like
+	// those opening a shared room link right away
+	defaultPlayerName = "Guest"
+)
+
 type (
 	MessageJoin struct {
-		Name   string `json:"name"`
-		RoomID string `json:"roomid"`
+		Name   string `json:"name" validate:"max=64"`
+		RoomID string `json:"roomid" validate:"required,max=64"`
+		// LastSeq is the last event seen before reconnecting
+		LastSeq int `json:"last_seq" validate:"min=0"`
 	}
 
 	MessageUserToggleReady struct {
 		Ready bool `json:"ready"`
 	}
 
-	MessageChangeStage struct {
-		Stage string `json:"stage"`
-	}
+	// MessageChangeStage moves the room to the stage after the current
+	// one, it has no payload
+	MessageChangeStage struct{}
 
 	MessageSetTimer struct {
-		TimeInSeconds int `json:"time_in_seconds"`
+		TimeInSeconds int `json:"time_in_seconds" validate:"min=0,max=86400"`
 	}
 
 	MessageListAdd struct {
@@ -33,13 +43,30 @@ type (
 	}
 
 	MessageListRemove struct {
-		ID string `json:"id"`
+		ID string `json:"id" validate:"required,max=32"`
 	}
 
 	MessageVote struct {
-		ID   string `json:"id"`
+		ID   string `json:"id" validate:"required,max=32"`
 		Vote bool   `json:"vote"`
 	}
+
+	// MessagePresence is focused, backgrounded or idle
+	MessagePresence struct {
+		Presence string `json:"presence" validate:"required"`
+	}
+)
+
+// Error codes sent to clients, see ws.Error
+const (
+	ErrorCodeNotHost       = "not_host"
+	ErrorCodeNotInRoom     = "not_in_room"
+	ErrorCodeRoomNotFound  = "room_not_found"
+	ErrorCodeStageMismatch = "stage_mismatch"
+	ErrorCodeAlreadyVoted  = "already_voted"
+	ErrorCodeAlreadyListed = "already_listed"
+	ErrorCodeShuttingDown  = "shutting_down"
+	ErrorCodeWrongRoom     = "wrong_room"
 )
 
 const (
@@ -50,72 +77,150 @@ const (
 	MessageTypeListAdd         = "list_add"
 	MessageTypeListRemove      = "list_remove"
 	MessageTypeVote            = "vote"
+	MessageTypePresence        = "presence"
 )
 
 type Handlers struct {
-	rooms RoomsRepository
+	rooms   RoomsRepository
+	events  RoomEventStore
+	archive RoomArchive
+	// hostActions has the message types only the host may send, with what
+	// they do
+	hostActions map[string]string
 }
 
-func NewHandlers(repo RoomsRepository) *Handlers {
+func NewHandlers(repo RoomsRepository, events RoomEventStore, archive RoomArchive) *Handlers {
 	return &Handlers{
-		rooms: repo,
+		rooms:   repo,
+		events:  events,
+		archive: archive,
+
+		hostActions: make(map[string]string),
 	}
 }
 
-func (h *Handlers) HandleJoin(sender *ws.Client, msg ws.MessageIncoming) {
-	var payload MessageJoin
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		sender.ReportError(err)
-		return
-	}
+// Register handles every message type clients send with manager
+func (h *Handlers) Register(manager *ws.ConnectionManager) {
+	ws.RegisterTyped(manager, MessageTypeJoin, h.HandleJoin)
+	ws.RegisterTyped(manager, MessageTypeUserToggleReady, h.HandleToggleReady, RequireRoom)
+	ws.RegisterTyped(manager, MessageTypeNextStage, h.HandleChangeStage, RequireRoom)
+	h.hostOnly(MessageTypeNextStage, "change stage")
+	ws.RegisterTyped(manager, MessageTypeSetTimer, h.HandleSetTimer, RequireRoom)
+	h.hostOnly(MessageTypeSetTimer, "set timer")
+	ws.RegisterTyped(manager, MessageTypeListAdd, h.HandleListAdd, RequireRoom)
+	ws.RegisterTyped(manager, MessageTypeListRemove, h.HandleListRemove, RequireRoom)
+	ws.RegisterTyped(manager, MessageTypeVote, h.HandleVote, RequireRoom)
+	ws.RegisterTyped(manager, MessageTypePresence, h.HandlePresence, RequireRoom)
+	manager.SetPresenceHandler(h.HandlePresenceChanged)
+}
 
-	err := h.rooms.Update(payload.RoomID, func(r *Room) error {
-		sender.Manager.AssignRoom(sender, payload.RoomID)
+// applyFunc applies a room event to the room being updated. Applied events
+// are appended to the room log once the update succeeds.
+type applyFunc func(eventType string, playerID string, payload any) error
 
-		newPlayer := Player{
-			ID:   sender.ID,
-			Name: payload.Name,
-		}
+// hostOnly makes updates triggered by messageType fail for anyone but the
+// host. It's checked on the room being updated, so a host change can't
+// slip in before the update.
+func (h *Handlers) hostOnly(messageType string, action string) {
+	h.hostActions[messageType] = action
+}
+
+// update runs updateFn on the room, trigger names the message sender sent
+// that caused it
+func (h *Handlers) update(trigger string, sender *ws.Client, roomID string, updateFn func(room *Room, apply applyFunc) error) error {
+	var recorded []RoomEvent
 
-		if len(r.Players) == 0 {
-			r.HostID = newPlayer.ID
+	err := updateTriggeredBy(h.rooms, trigger, roomID, func(room *Room) error {
+		recorded = nil
+
+		if action, ok := h.hostActions[trigger]; ok && room.HostID != sender.ID {
+			return ws.NewError(ErrorCodeNotHost, "Only host can %s", action)
 		}
-		r.Players[sender.ID] = newPlayer
 
-		sender.Send(NewEventRoomInit(newPlayer, *r))
-		playerJoined := NewEventPlayerJoined(newPlayer)
-		playersChanged := NewEventPlayersChanged(*r)
-		sender.Manager.BroadcastFunc(r.ID, func(c *ws.Client) {
-			if c != sender {
-				c.Send(playerJoined)
+		return updateFn(room, func(eventType string, playerID string, payload any) error {
+			event, err := NewRoomEvent(*room, eventType, playerID, payload)
+			if err != nil {
+				return err
 			}
-			c.Send(playersChanged)
-		})
 
-		if r.ScheduledForDeletion {
-			r.ScheduledForDeletion = false
-		}
+			if err := room.Apply(event); err != nil {
+				return err
+			}
+			recorded = append(recorded, event)
 
-		return nil
+			return nil
+		})
 	})
-
+	if errors.Is(err, ErrRoomNotFound) {
+		return ws.NewError(ErrorCodeRoomNotFound, "Room doesn't exist")
+	}
+	if errors.Is(err, ErrRoomsDraining) {
+		return ws.NewError(ErrorCodeShuttingDown, "Server is shutting down, try again in a moment")
+	}
 	if err != nil {
-		sender.ReportError(err)
-		return
+		return err
 	}
+
+	h.events.Append(recorded...)
+
+	return nil
+}
+
+func (h *Handlers) CreateRoom() Room {
+	room := NewRoom()
+
+	event, _ := NewRoomEvent(room, RoomEventCreated, "", nil)
+	room.Apply(event)
+
+	h.rooms.Add(room)
+	h.events.Append(event)
+
+	return room
 }
 
-func (h *Handlers) HandleToggleReady(sender *ws.Client, msg ws.MessageIncoming) {
-	var payload MessageUserToggleReady
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		sender.ReportError(err)
-		return
+func (h *Handlers) HandleJoin(sender *ws.Client, payload MessageJoin) error {
+	if sender.AuthorizedRoomID != "" && payload.RoomID != sender.AuthorizedRoomID {
+		return ws.NewError(ErrorCodeWrongRoom, "Connection wasn't opened for this room")
+	}
+
+	// A player reconnecting within the grace period, or opening another
+	// tab, is still in the room, they only need what they missed
+	resumed, replayed := sender.Manager.Resume(sender, payload.RoomID, payload.LastSeq)
+	if resumed {
+		if room := h.rooms.Find(payload.RoomID); room != nil && !replayed {
+			sender.Sync(NewEventRoomInit(room.Players[sender.ID], *room))
+		}
+		return nil
 	}
 
-	h.rooms.Update(sender.RoomID, func(r *Room) error {
+	return h.update(MessageTypeJoin, sender, payload.RoomID, func(r *Room, apply applyFunc) error {
+		sender.Manager.AssignRoom(sender, payload.RoomID)
+
+		name := payload.Name
+		if name == "" {
+			name = defaultPlayerName
+		}
+
+		err := apply(RoomEventJoined, sender.ID, roomEventJoined{Name: name})
+		if err != nil {
+			return err
+		}
+		newPlayer := r.Players[sender.ID]
+
+		sender.Send(NewEventRoomInit(newPlayer, *r))
+		sender.Manager.BroadcastExcept(r.ID, sender.ID, NewEventPlayerJoined(newPlayer, *r))
+		sender.Manager.Broadcast(r.ID, NewEventPlayersChanged(*r))
+
+		return nil
+	})
+}
+
+func (h *Handlers) HandleToggleReady(sender *ws.Client, payload MessageUserToggleReady) error {
+	return h.update(MessageTypeUserToggleReady, sender, sender.RoomID, func(r *Room, apply applyFunc) error {
+		if err := apply(RoomEventReadyToggled, sender.ID, payload); err != nil {
+			return err
+		}
 		p := r.Players[sender.ID]
-		p.Ready = payload.Ready
-		r.Players[sender.ID] = p
 
 		sender.Send(NewPlayerUpdatedEvent(p, *r))
 		sender.Manager.Broadcast(r.ID, NewEventPlayersChanged(*r))
@@ -125,198 +230,195 @@ func (h *Handlers) HandleToggleReady(sender *ws.Client, msg ws.MessageIncoming)
 }
 
 func (h *Handlers) HandleLeave(sender *ws.Client) {
-	h.rooms.Update(sender.RoomID, func(room *Room) error {
-		delete(room.Players, sender.ID)
+	h.update(RoomEventLeft, sender, sender.RoomID, func(room *Room, apply applyFunc) error {
+		wasHost := room.HostID == sender.ID
 
-		if room.HostID == sender.ID {
-			var nextHostID string
+		var nextHostID string
+		if wasHost {
 			for _, p := range room.Players {
-				nextHostID = p.ID
-				break
+				if p.ID != sender.ID {
+					nextHostID = p.ID
+					break
+				}
 			}
+		}
 
-			room.HostID = nextHostID
+		err := apply(RoomEventLeft, sender.ID, roomEventLeft{NextHostID: nextHostID})
+		if err != nil {
+			return err
+		}
 
-			if room.HostID != "" {
-				hostChanged := NewHostChangedEvent(room.Players[room.HostID])
-				sender.Manager.BroadcastFunc(room.ID, func(c *ws.Client) {
-					c.Send(hostChanged)
-					// notify new host that its data changed
-					if c.ID == room.HostID {
-						c.Send(NewPlayerUpdatedEvent(room.Players[c.ID], *room))
-					}
-				})
-			}
+		if wasHost && room.HostID != "" {
+			newHost := room.Players[room.HostID]
+			sender.Manager.Broadcast(room.ID, NewHostChangedEvent(newHost, *room))
+			// notify new host that its data changed
+			sender.Manager.SendTo(room.ID, newHost.ID, NewPlayerUpdatedEvent(newHost, *room))
 		}
 
 		sender.Manager.Broadcast(room.ID, NewEventPlayersChanged(*room))
 
-		if len(room.Players) == 0 {
-			room.ScheduledForDeletion = true
+		return nil
+	})
+}
+
+// HandlePresence records what the client reports, the player's presence
+// changes through HandlePresenceChanged
+func (h *Handlers) HandlePresence(sender *ws.Client, payload MessagePresence) error {
+	presence, err := ws.ParseReportedPresence(payload.Presence)
+	if err != nil {
+		wsErr := ws.NewError(ws.ErrorCodeInvalidPayload, "Invalid payload: %s", err.Error())
+		wsErr.Fields = []ws.FieldError{{Field: "presence", Rule: "presence", Message: err.Error()}}
+
+		return wsErr
+	}
+	sender.SetPresence(presence)
+
+	return nil
+}
+
+func (h *Handlers) HandlePresenceChanged(sender *ws.Client, presence ws.Presence) {
+	err := h.update(MessageTypePresence, sender, sender.RoomID, func(room *Room, apply applyFunc) error {
+		if _, ok := room.Players[sender.ID]; !ok {
+			// the player left before their presence was reported
+			return nil
+		}
+		if err := apply(RoomEventPresenceChanged, sender.ID, roomEventPresenceChanged{Presence: presence}); err != nil {
+			return err
 		}
+		sender.Manager.Broadcast(room.ID, NewEventPlayersChanged(*room))
 
 		return nil
 	})
+	if err != nil {
+		log.Printf("in HandlePresenceChanged. Failed to update presence of %s: %s", sender.ID, err.Error())
+	}
 }
 
-func (h *Handlers) HandleChangeStage(sender *ws.Client, _ ws.MessageIncoming) {
-	err := h.rooms.Update(sender.RoomID, func(room *Room) error {
-		user := room.Players[sender.ID]
-		if user.ID != room.HostID {
-			return fmt.Errorf("Only host can change stage")
-		}
+func (h *Handlers) HandleChangeStage(sender *ws.Client, payload MessageChangeStage) error {
+	var finished *ArchivedRoom
 
+	err := h.update(MessageTypeNextStage, sender, sender.RoomID, func(room *Room, apply applyFunc) error {
 		if room.Stage == StageResults {
-			return fmt.Errorf("Can't change stage. Final stage reached")
+			return ws.NewError(ErrorCodeStageMismatch, "Can't change stage. Final stage reached")
 		}
 
-		room.Stage = RoomStage(nextStageMap[string(room.Stage)])
+		stageChanged := roomEventStageChanged{
+			Stage: RoomStage(nextStageMap[string(room.Stage)]),
+		}
+		if stageChanged.Stage == StageVoting {
+			stageChanged.Candidates = collectCandidates(*room)
+		}
+
+		if err := apply(RoomEventStageChanged, sender.ID, stageChanged); err != nil {
+			return err
+		}
 
 		switch room.Stage {
 		case StageVoting:
 			// Currently need to emit player updated event to update actions
 			// Think of different strategy for updating actions
-			for _, p := range room.Players {
-				p.Ready = false
-				room.Players[p.ID] = p
+			for _, player := range room.Players {
+				sender.Manager.SendTo(room.ID, player.ID, NewPlayerUpdatedEvent(player, *room))
 			}
-			sender.Manager.BroadcastFunc(room.ID, func(c *ws.Client) {
-				c.Send(NewPlayerUpdatedEvent(room.Players[c.ID], *room))
-			})
 			sender.Manager.Broadcast(room.ID, NewEventPlayersChanged(*room))
-
-			room.Candidates = collectCandidates(*room)
 			sender.Manager.Broadcast(room.ID, NewEventStageVoting(*room))
 
 		case StageResults:
 			sender.Manager.Broadcast(room.ID, NewEventStageResults(*room))
+
+			archived := NewArchivedRoom(*room)
+			finished = &archived
 		}
 
 		return nil
 	})
 
 	if err != nil {
-		sender.ReportError(err)
+		return err
 	}
-}
 
-func (h *Handlers) HandleSetTimer(sender *ws.Client, msg ws.MessageIncoming) {
-	err := h.rooms.Update(sender.RoomID, func(room *Room) error {
-		user := room.Players[sender.ID]
-		if user.ID != room.HostID {
-			return fmt.Errorf("Only host can set timer")
-		}
+	if finished != nil {
+		h.archive.Add(*finished)
+	}
 
-		var payload MessageSetTimer
-		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+	return nil
+}
+
+func (h *Handlers) HandleSetTimer(sender *ws.Client, payload MessageSetTimer) error {
+	return h.update(MessageTypeSetTimer, sender, sender.RoomID, func(room *Room, apply applyFunc) error {
+		if err := apply(RoomEventTimerSet, sender.ID, payload); err != nil {
 			return err
 		}
-
-		room.Time = time.Duration(payload.TimeInSeconds) * time.Second
 		sender.Manager.Broadcast(room.ID, NewTimerSetEvent(*room))
 
 		return nil
 	})
-
-	if err != nil {
-		sender.ReportError(err)
-	}
 }
 
-func (h *Handlers) HandleListAdd(sender *ws.Client, msg ws.MessageIncoming) {
-	var payload MessageListAdd
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		sender.ReportError(err)
-		return
-	}
-
-	err := h.rooms.Update(sender.RoomID, func(room *Room) error {
+func (h *Handlers) HandleListAdd(sender *ws.Client, payload MessageListAdd) error {
+	return h.update(MessageTypeListAdd, sender, sender.RoomID, func(room *Room, apply applyFunc) error {
 		user := room.Players[sender.ID]
 		newItemID := strconv.Itoa(payload.ID)
 
 		if slices.ContainsFunc(room.Lists[user.ID], func(item ListItem) bool {
 			return item.ID == newItemID
 		}) {
-			return fmt.Errorf("Item already in the list")
+			return ws.NewError(ErrorCodeAlreadyListed, "Item already in the list")
 		}
 
-		listItem := ListItem{
+		item := listItem{
 			ID:         newItemID,
 			Title:      payload.Title,
 			Overview:   payload.Overview,
 			Rating:     payload.Rating,
 			PosterPath: payload.PosterPath,
 		}
-		listItem.ReleaseDate, _ = time.Parse("2006-01-02", payload.ReleaseDate)
+		item.ReleaseDate, _ = time.Parse("2006-01-02", payload.ReleaseDate)
 
-		room.Lists[user.ID] = append(room.Lists[user.ID], listItem)
+		if err := apply(RoomEventListAdded, user.ID, item); err != nil {
+			return err
+		}
 
-		listChanged := NewEventListChanged(room.Lists[user.ID])
+		listChanged := NewEventListChanged(room.Lists[user.ID], *room)
 		sender.Send(listChanged)
 
 		return nil
 	})
-
-	if err != nil {
-		sender.ReportError(err)
-	}
 }
 
-func (h *Handlers) HandleListRemove(sender *ws.Client, msg ws.MessageIncoming) {
-	var payload MessageListRemove
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		sender.ReportError(err)
-		return
-	}
-
-	err := h.rooms.Update(sender.RoomID, func(room *Room) error {
+func (h *Handlers) HandleListRemove(sender *ws.Client, payload MessageListRemove) error {
+	return h.update(MessageTypeListRemove, sender, sender.RoomID, func(room *Room, apply applyFunc) error {
 		user := room.Players[sender.ID]
 
-		updatedList := slices.DeleteFunc(room.Lists[user.ID], func(v ListItem) bool {
-			return v.ID == payload.ID
-		})
-
-		room.Lists[user.ID] = updatedList
-		sender.Send(NewEventListChanged(updatedList))
+		if err := apply(RoomEventListRemoved, user.ID, payload); err != nil {
+			return err
+		}
+		sender.Send(NewEventListChanged(room.Lists[user.ID], *room))
 
 		return nil
 	})
-
-	if err != nil {
-		sender.ReportError(err)
-	}
 }
 
-func (h *Handlers) HandleVote(sender *ws.Client, msg ws.MessageIncoming) {
-	var payload MessageVote
-	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-		sender.ReportError(err)
-		return
-	}
-
-	err := h.rooms.Update(sender.RoomID, func(room *Room) error {
+func (h *Handlers) HandleVote(sender *ws.Client, payload MessageVote) error {
+	return h.update(MessageTypeVote, sender, sender.RoomID, func(room *Room, apply applyFunc) error {
 		if room.Stage != StageVoting {
-			return fmt.Errorf("Not in voting stage")
+			return ws.NewError(ErrorCodeStageMismatch, "Not in voting stage")
 		}
 
 		user := room.Players[sender.ID]
-		for i, candidate := range room.Candidates {
-			if candidate.ID == payload.ID {
-				if slices.Contains(candidate.Voters, user.ID) {
-					return fmt.Errorf("Already voted for %s", candidate.ID)
-				}
-
-				room.Candidates[i].Voters = append(room.Candidates[i].Voters, user.ID)
-				if payload.Vote {
-					room.Candidates[i].Score++
-				}
+		for _, candidate := range room.Candidates {
+			if candidate.ID == payload.ID && slices.Contains(candidate.Voters, user.ID) {
+				return ws.NewError(ErrorCodeAlreadyVoted, "Already voted for %s", candidate.ID)
 			}
 		}
 
+		if err := apply(RoomEventVoted, user.ID, payload); err != nil {
+			return err
+		}
+		user = room.Players[user.ID]
+
 		event := NewEventVoteRegistered(user, *room)
 		if len(event.CandidatesLeft) == 0 {
-			user.Ready = true
-			room.Players[user.ID] = user
 			sender.Send(NewPlayerUpdatedEvent(user, *room))
 			sender.Manager.Broadcast(room.ID, NewEventPlayersChanged(*room))
 		}
@@ -324,18 +426,15 @@ func (h *Handlers) HandleVote(sender *ws.Client, msg ws.MessageIncoming) {
 
 		return nil
 	})
-
-	if err != nil {
-		sender.ReportError(err)
-	}
 }
 
 type (
 	player struct {
-		ID     string `json:"id"`
-		Name   string `json:"name"`
-		Ready  bool   `json:"ready"`
-		IsHost bool   `json:"isHost"`
+		ID       string      `json:"id"`
+		Name     string      `json:"name"`
+		Ready    bool        `json:"ready"`
+		IsHost   bool        `json:"isHost"`
+		Presence ws.Presence `json:"presence"`
 	}
 
 	listItem struct {
@@ -356,6 +455,7 @@ type (
 type (
 	EventRoomInit struct {
 		Type       string         `json:"type"`
+		Version    int            `json:"version"`
 		ID         string         `json:"id"`
 		User       player         `json:"user"`
 		Stage      RoomStage      `json:"stage"`
@@ -369,55 +469,64 @@ type (
 	}
 
 	EventPlayerJoined struct {
-		Type string `json:"type"`
-		ID   string `json:"id"`
-		Name string `json:"name"`
+		Type    string `json:"type"`
+		Version int    `json:"version"`
+		ID      string `json:"id"`
+		Name    string `json:"name"`
 	}
 
 	EventPlayersChanged struct {
 		Type    string   `json:"type"`
+		Version int      `json:"version"`
 		Ready   int      `json:"ready"`
 		Total   int      `json:"total"`
 		Players []player `json:"players"`
 	}
 
 	EventPlayerUpdated struct {
-		Type   string `json:"type"`
-		ID     string `json:"id"`
-		Name   string `json:"name"`
-		Ready  bool   `json:"ready"`
-		IsHost bool   `json:"isHost"`
+		Type    string `json:"type"`
+		Version int    `json:"version"`
+		ID      string `json:"id"`
+		Name    string `json:"name"`
+		Ready   bool   `json:"ready"`
+		IsHost  bool   `json:"isHost"`
 	}
 
 	EventHostChanged struct {
-		Type string `json:"type"`
-		ID   string `json:"id"`
-		Name string `json:"name"`
+		Type    string `json:"type"`
+		Version int    `json:"version"`
+		ID      string `json:"id"`
+		Name    string `json:"name"`
 	}
 
 	EventTimerSet struct {
-		Type string        `json:"type"`
-		Time time.Duration `json:"time"`
+		Type    string        `json:"type"`
+		Version int           `json:"version"`
+		Time    time.Duration `json:"time"`
 	}
 
 	EventRoomTime struct {
-		Type string        `json:"type"`
-		Time time.Duration `json:"time"`
+		Type    string        `json:"type"`
+		Version int           `json:"version"`
+		Time    time.Duration `json:"time"`
 	}
 
 	EventListChanged struct {
-		Type string     `json:"type"`
-		List []listItem `json:"list"`
+		Type    string     `json:"type"`
+		Version int        `json:"version"`
+		List    []listItem `json:"list"`
 	}
 
 	EventStageVoting struct {
 		Type       string      `json:"type"`
+		Version    int         `json:"version"`
 		Total      int         `json:"total"`
 		Candidates []candidate `json:"candidates"`
 	}
 
 	EventVoteRegistered struct {
 		Type           string      `json:"type"`
+		Version        int         `json:"version"`
 		Total          int         `json:"total"`
 		CandidatesLeft []candidate `json:"candidates"`
 	}
@@ -429,9 +538,16 @@ type (
 
 	EventStageResults struct {
 		Type    string         `json:"type"`
+		Version int            `json:"version"`
 		Winners []resultsEntry `json:"winners"`
 		Others  []resultsEntry `json:"others"`
 	}
+
+	EventRoomClosed struct {
+		Type    string `json:"type"`
+		Version int    `json:"version"`
+		Reason  string `json:"reason"`
+	}
 )
 
 const (
@@ -445,11 +561,21 @@ const (
 	EventTypeStageVoting    = "room:stage_voting"
 	EventTypeVoteRegistered = "room:vote_registered"
 	EventTypeStageResults   = "room:stage_results"
+	EventTypeRoomClosed     = "room:closed"
 
 	EventTypePlayerUpdated = "player:update"
 	EventTypeListChanged   = "player:list_changed"
 )
 
+// State events replace whatever the previous one of their kind showed, so a
+// slow client only needs the latest.
+func (e EventPlayersChanged) CoalesceKey() string { return EventTypePlayersChanged }
+func (e EventPlayerUpdated) CoalesceKey() string  { return EventTypePlayerUpdated }
+func (e EventTimerSet) CoalesceKey() string       { return EventTypeRoomTime }
+func (e EventRoomTime) CoalesceKey() string       { return EventTypeRoomTime }
+func (e EventListChanged) CoalesceKey() string    { return EventTypeListChanged }
+func (e EventVoteRegistered) CoalesceKey() string { return EventTypeVoteRegistered }
+
 const (
 	LimitCandidates = 5
 )
@@ -459,10 +585,11 @@ func NewEventRoomInit(user Player, room Room) EventRoomInit {
 
 	for _, v := range room.Players {
 		players = append(players, player{
-			ID:     v.ID,
-			Name:   v.Name,
-			Ready:  v.Ready,
-			IsHost: v.ID == room.HostID,
+			ID:       v.ID,
+			Name:     v.Name,
+			Ready:    v.Ready,
+			IsHost:   v.ID == room.HostID,
+			Presence: v.Presence,
 		})
 	}
 
@@ -484,13 +611,15 @@ func NewEventRoomInit(user Player, room Room) EventRoomInit {
 	candidates := transformCandidates(tail(remaining, LimitCandidates))
 
 	return EventRoomInit{
-		Type: EventTypeRoomInit,
-		ID:   room.ID,
+		Type:    EventTypeRoomInit,
+		Version: room.Version,
+		ID:      room.ID,
 		User: player{
-			ID:     user.ID,
-			Name:   user.Name,
-			Ready:  user.Ready,
-			IsHost: room.HostID == user.ID,
+			ID:       user.ID,
+			Name:     user.Name,
+			Ready:    user.Ready,
+			IsHost:   room.HostID == user.ID,
+			Presence: user.Presence,
 		},
 		Time:       room.Time,
 		List:       list,
@@ -503,11 +632,12 @@ func NewEventRoomInit(user Player, room Room) EventRoomInit {
 	}
 }
 
-func NewEventPlayerJoined(p Player) EventPlayerJoined {
+func NewEventPlayerJoined(p Player, room Room) EventPlayerJoined {
 	return EventPlayerJoined{
-		Type: EventTypePlayerJoined,
-		ID:   p.ID,
-		Name: p.Name,
+		Type:    EventTypePlayerJoined,
+		Version: room.Version,
+		ID:      p.ID,
+		Name:    p.Name,
 	}
 }
 
@@ -522,15 +652,17 @@ func NewEventPlayersChanged(room Room) EventPlayersChanged {
 		}
 
 		players = append(players, player{
-			ID:     v.ID,
-			Name:   v.Name,
-			Ready:  v.Ready,
-			IsHost: v.ID == room.HostID,
+			ID:       v.ID,
+			Name:     v.Name,
+			Ready:    v.Ready,
+			IsHost:   v.ID == room.HostID,
+			Presence: v.Presence,
 		})
 	}
 
 	return EventPlayersChanged{
 		Type:    EventTypePlayersChanged,
+		Version: room.Version,
 		Ready:   ready,
 		Total:   total,
 		Players: players,
@@ -539,18 +671,21 @@ func NewEventPlayersChanged(room Room) EventPlayersChanged {
 
 func NewPlayerUpdatedEvent(p Player, room Room) EventPlayerUpdated {
 	return EventPlayerUpdated{
-		Type:   EventTypePlayerUpdated,
-		ID:     p.ID,
-		Name:   p.Name,
-		Ready:  p.Ready,
-		IsHost: p.ID == room.HostID,
+		Type:    EventTypePlayerUpdated,
+		Version: room.Version,
+		ID:      p.ID,
+		Name:    p.Name,
+		Ready:   p.Ready,
+		IsHost:  p.ID == room.HostID,
 	}
 }
 
-func NewHostChangedEvent(newHost Player) EventHostChanged {
+func NewHostChangedEvent(newHost Player, room Room) EventHostChanged {
 	return EventHostChanged{
-		ID:   newHost.ID,
-		Name: newHost.Name,
+		Type:    EventTypeHostChanged,
+		Version: room.Version,
+		ID:      newHost.ID,
+		Name:    newHost.Name,
 	}
 }
 
@@ -562,27 +697,30 @@ var nextStageMap = map[string]string{
 
 func NewTimerSetEvent(room Room) EventTimerSet {
 	return EventTimerSet{
-		Type: EventTypeTimerSet,
-		Time: room.Time,
+		Type:    EventTypeTimerSet,
+		Version: room.Version,
+		Time:    room.Time,
 	}
 }
 
 func NewEventRoomTime(room Room) EventRoomTime {
 	return EventRoomTime{
-		Type: EventTypeRoomTime,
-		Time: room.Time,
+		Type:    EventTypeRoomTime,
+		Version: room.Version,
+		Time:    room.Time,
 	}
 }
 
-func NewEventListChanged(list []ListItem) EventListChanged {
+func NewEventListChanged(list []ListItem, room Room) EventListChanged {
 	eventList := make([]listItem, len(list))
 	for i, v := range list {
 		eventList[i] = listItem(v)
 	}
 
 	return EventListChanged{
-		Type: EventTypeListChanged,
-		List: eventList,
+		Type:    EventTypeListChanged,
+		Version: room.Version,
+		List:    eventList,
 	}
 }
 
@@ -622,6 +760,7 @@ func transformCandidates(candidates []Candidate) []candidate {
 func NewEventStageVoting(room Room) EventStageVoting {
 	return EventStageVoting{
 		Type:       EventTypeStageVoting,
+		Version:    room.Version,
 		Total:      len(room.Candidates),
 		Candidates: transformCandidates(tail(room.Candidates, LimitCandidates)),
 	}
@@ -646,6 +785,7 @@ func NewEventVoteRegistered(voter Player, room Room) EventVoteRegistered {
 
 	return EventVoteRegistered{
 		Type:           EventTypeVoteRegistered,
+		Version:        room.Version,
 		Total:          len(remaining),
 		CandidatesLeft: candidates,
 	}
@@ -687,11 +827,20 @@ func NewEventStageResults(room Room) EventStageResults {
 
 	return EventStageResults{
 		Type:    EventTypeStageResults,
+		Version: room.Version,
 		Winners: winners,
 		Others:  others,
 	}
 }
 
+func NewEventRoomClosed(room Room, reason string) EventRoomClosed {
+	return EventRoomClosed{
+		Type:    EventTypeRoomClosed,
+		Version: room.Version,
+		Reason:  reason,
+	}
+}
+
 func tail[S ~[]E, E any](s S, n int) S {
 	start := max(len(s)-n-1, 0)
 	return s[start:]
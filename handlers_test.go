@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"stmsh/pkg/ws"
+)
+
+const (
+	// eventTimeout is how long a player waits for each expected event
+	eventTimeout = time.Second
+	// quietPeriod is how long a player waits to be sure nothing else comes
+	quietPeriod = 50 * time.Millisecond
+
+	// eventTypeClose stands for the close frame in expected events
+	eventTypeClose = "close"
+)
+
+// testRoom runs the message handlers of a single room, players connect to
+// it over in-memory connections
+type testRoom struct {
+	t       *testing.T
+	ID      string
+	rooms   *InMemoryRoomsRepository
+	events  *InMemoryRoomEventStore
+	manager *ws.ConnectionManager
+}
+
+func newTestRoom(t *testing.T) *testRoom {
+	t.Helper()
+
+	rooms := NewInMemoryRoomsRepository()
+	events := NewInMemoryRoomEventStore()
+	handlers := NewHandlers(rooms, events, NewInMemoryRoomArchive())
+
+	options := ws.DefaultOptions
+	// players leave as soon as they disconnect
+	options.ResumeGrace = 0
+	options.RateLimits = nil
+	manager := ws.NewConnectionManager(handlers.HandleLeave, options)
+	handlers.Register(manager)
+
+	return &testRoom{
+		t:       t,
+		ID:      handlers.CreateRoom().ID,
+		rooms:   rooms,
+		events:  events,
+		manager: manager,
+	}
+}
+
+// connect opens a connection for the player with id, without joining
+func (r *testRoom) connect(id string) *testPlayer {
+	r.t.Helper()
+
+	conn := ws.NewMemoryConn()
+	client := ws.NewClient(conn, r.manager, jsonSerializer)
+	client.ID = id
+	client.AuthorizedRoomID = r.ID
+	r.manager.AddClient(client)
+
+	go client.WriteMessages()
+	go client.ReadMessages()
+	r.t.Cleanup(func() { conn.Close() })
+
+	return &testPlayer{t: r.t, ID: id, conn: conn}
+}
+
+// join connects the player with id and joins the room as name
+func (r *testRoom) join(id string, name string) *testPlayer {
+	r.t.Helper()
+
+	p := r.connect(id)
+	p.send(MessageTypeJoin, MessageJoin{Name: name, RoomID: r.ID})
+
+	return p
+}
+
+type testPlayer struct {
+	t    *testing.T
+	ID   string
+	conn *ws.MemoryConn
+}
+
+// testEvent is an event as the client decoded it
+type testEvent map[string]any
+
+func (p *testPlayer) send(messageType string, payload any) {
+	p.t.Helper()
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		p.t.Fatalf("Failed to encode %s payload: %s", messageType, err.Error())
+	}
+	data, _ := json.Marshal(ws.MessageIncoming{Type: messageType, Payload: raw})
+
+	if err := p.conn.Send(data); err != nil {
+		p.t.Fatalf("Player %s failed to send %s: %s", p.ID, messageType, err.Error())
+	}
+}
+
+// disconnect closes the connection like a closed tab would
+func (p *testPlayer) disconnect() {
+	p.conn.Close()
+}
+
+// next returns the next event, skipping pings
+func (p *testPlayer) next() (testEvent, error) {
+	for {
+		frame, err := p.conn.Receive(eventTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		switch frame.Type {
+		case websocket.PingMessage:
+			continue
+
+		case websocket.CloseMessage:
+			return testEvent{"type": eventTypeClose, "data": string(frame.Data)}, nil
+		}
+
+		var event testEvent
+		if err := json.Unmarshal(frame.Data, &event); err != nil {
+			return nil, err
+		}
+
+		return event, nil
+	}
+}
+
+// expect checks that the next events p receives have exactly these types,
+// in this order, and returns them
+func (p *testPlayer) expect(types ...string) []testEvent {
+	p.t.Helper()
+
+	events := make([]testEvent, 0, len(types))
+	received := make([]string, 0, len(types))
+	for range types {
+		event, err := p.next()
+		if err != nil {
+			p.t.Fatalf("Player %s expected %v, got %v and then %s", p.ID, types, received, err.Error())
+		}
+
+		events = append(events, event)
+		received = append(received, event.Type())
+	}
+
+	if !slices.Equal(received, types) {
+		p.t.Fatalf("Player %s expected %v, got %v", p.ID, types, received)
+	}
+
+	return events
+}
+
+// expectNothing checks that p doesn't receive anything else
+func (p *testPlayer) expectNothing() {
+	p.t.Helper()
+
+	frame, err := p.conn.Receive(quietPeriod)
+	if errors.Is(err, ws.ErrMemoryConnTimeout) || errors.Is(err, ws.ErrMemoryConnClosed) {
+		return
+	}
+	if err != nil {
+		p.t.Fatalf("Player %s failed to receive: %s", p.ID, err.Error())
+	}
+
+	p.t.Fatalf("Player %s expected nothing, got %s", p.ID, frame.Data)
+}
+
+// expectError checks that the next event is an error with code
+func (p *testPlayer) expectError(code string) {
+	p.t.Helper()
+
+	event := p.expect(ws.MessageTypeError)[0]
+	if event["code"] != code {
+		p.t.Fatalf("Player %s expected error %s, got %v", p.ID, code, event)
+	}
+}
+
+func (e testEvent) Type() string {
+	t, _ := e["type"].(string)
+	return t
+}
+
+// joinPlayers joins players named after their IDs one after another, and
+// takes everyone through the events of each join
+func joinPlayers(r *testRoom, ids ...string) []*testPlayer {
+	r.t.Helper()
+
+	players := make([]*testPlayer, 0, len(ids))
+	for _, id := range ids {
+		joined := r.join(id, id)
+		joined.expect(EventTypeRoomInit, EventTypePlayersChanged)
+		for _, p := range players {
+			p.expect(EventTypePlayerJoined, EventTypePlayersChanged)
+		}
+
+		players = append(players, joined)
+	}
+
+	return players
+}
+
+func TestJoin(t *testing.T) {
+	r := newTestRoom(t)
+	players := joinPlayers(r, "a", "b", "c")
+
+	for _, p := range players {
+		p.expectNothing()
+	}
+
+	room := r.rooms.Find(r.ID)
+	if len(room.Players) != 3 || room.HostID != "a" {
+		t.Fatalf("Expected 3 players hosted by a, got %d hosted by %s", len(room.Players), room.HostID)
+	}
+}
+
+func TestJoinOtherRoom(t *testing.T) {
+	r := newTestRoom(t)
+	other := r.rooms.Find(r.ID)
+	other.ID = "other"
+	r.rooms.Add(*other)
+
+	p := r.connect("a")
+	p.send(MessageTypeJoin, MessageJoin{Name: "a", RoomID: "other"})
+	p.expectError(ErrorCodeWrongRoom)
+	p.expectNothing()
+
+	if len(r.rooms.Find("other").Players) != 0 {
+		t.Fatal("Expected a not to join the other room")
+	}
+}
+
+func TestJoinWithoutName(t *testing.T) {
+	r := newTestRoom(t)
+	p := r.join("a", "")
+	p.expect(EventTypeRoomInit, EventTypePlayersChanged)
+
+	if name := r.rooms.Find(r.ID).Players["a"].Name; name != defaultPlayerName {
+		t.Fatalf("Expected %q, got %q", defaultPlayerName, name)
+	}
+}
+
+func TestValidateMessageJoin(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload MessageJoin
+		invalid string
+	}{
+		{name: "valid", payload: MessageJoin{Name: "Ann", RoomID: "room"}},
+		{name: "without name", payload: MessageJoin{RoomID: "room"}},
+		{name: "longest name", payload: MessageJoin{Name: strings.Repeat("ä", maxPlayerNameLength), RoomID: "room"}},
+		{name: "name too long", payload: MessageJoin{Name: strings.Repeat("a", maxPlayerNameLength+1), RoomID: "room"}, invalid: "name"},
+		{name: "without room", payload: MessageJoin{Name: "Ann"}, invalid: "roomid"},
+		{name: "negative seq", payload: MessageJoin{Name: "Ann", RoomID: "room", LastSeq: -1}, invalid: "last_seq"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fields := ws.Validate(tc.payload)
+			if tc.invalid == "" {
+				if len(fields) > 0 {
+					t.Fatalf("Expected valid payload, got %v", fields)
+				}
+				return
+			}
+			if len(fields) != 1 || fields[0].Field != tc.invalid {
+				t.Fatalf("Expected %s to be invalid, got %v", tc.invalid, fields)
+			}
+		})
+	}
+}
+
+func TestToggleReady(t *testing.T) {
+	r := newTestRoom(t)
+	players := joinPlayers(r, "a", "b")
+	a, b := players[0], players[1]
+
+	b.send(MessageTypeUserToggleReady, MessageUserToggleReady{Ready: true})
+	updated := b.expect(EventTypePlayerUpdated, EventTypePlayersChanged)
+	if updated[0]["ready"] != true {
+		t.Fatalf("Expected b to be ready, got %v", updated[0])
+	}
+	if updated[1]["ready"] != float64(1) {
+		t.Fatalf("Expected 1 ready player, got %v", updated[1])
+	}
+
+	a.expect(EventTypePlayersChanged)
+	a.expectNothing()
+}
+
+func TestNextStageRequiresHost(t *testing.T) {
+	r := newTestRoom(t)
+	players := joinPlayers(r, "a", "b")
+	a, b := players[0], players[1]
+
+	b.send(MessageTypeNextStage, nil)
+	b.expectError(ErrorCodeNotHost)
+	b.send(MessageTypeSetTimer, MessageSetTimer{TimeInSeconds: 60})
+	b.expectError(ErrorCodeNotHost)
+
+	a.expectNothing()
+	b.expectNothing()
+}
+
+func TestMessagesRequireRoom(t *testing.T) {
+	r := newTestRoom(t)
+	p := r.connect("a")
+
+	p.send(MessageTypeUserToggleReady, MessageUserToggleReady{Ready: true})
+	p.expectError(ErrorCodeNotInRoom)
+	p.expectNothing()
+}
+
+func TestVotingRound(t *testing.T) {
+	r := newTestRoom(t)
+	players := joinPlayers(r, "a", "b")
+	a, b := players[0], players[1]
+
+	a.send(MessageTypeListAdd, MessageListAdd{TMDBMovie{ID: 1, Title: "First"}})
+	a.expect(EventTypeListChanged)
+	b.send(MessageTypeListAdd, MessageListAdd{TMDBMovie{ID: 2, Title: "Second"}})
+	b.expect(EventTypeListChanged)
+
+	a.send(MessageTypeNextStage, nil)
+	for _, p := range players {
+		p.expect(EventTypePlayerUpdated, EventTypePlayersChanged, EventTypeStageVoting)
+	}
+
+	a.send(MessageTypeVote, MessageVote{ID: "1", Vote: true})
+	a.expect(EventTypeVoteRegistered)
+	a.send(MessageTypeVote, MessageVote{ID: "1", Vote: true})
+	a.expectError(ErrorCodeAlreadyVoted)
+
+	// the last vote finishes a player's candidates
+	a.send(MessageTypeVote, MessageVote{ID: "2", Vote: false})
+	a.expect(EventTypePlayerUpdated, EventTypePlayersChanged, EventTypeVoteRegistered)
+	b.expect(EventTypePlayersChanged)
+
+	b.send(MessageTypeVote, MessageVote{ID: "1", Vote: true})
+	b.expect(EventTypeVoteRegistered)
+	b.send(MessageTypeVote, MessageVote{ID: "2", Vote: true})
+	b.expect(EventTypePlayerUpdated, EventTypePlayersChanged, EventTypeVoteRegistered)
+	a.expect(EventTypePlayersChanged)
+
+	a.send(MessageTypeNextStage, nil)
+	for _, p := range players {
+		results := p.expect(EventTypeStageResults)[0]
+		winners, _ := results["winners"].([]any)
+		if len(winners) != 1 {
+			t.Fatalf("Expected a single winner, got %v", results["winners"])
+		}
+		p.expectNothing()
+	}
+}
+
+func TestHostLeaves(t *testing.T) {
+	r := newTestRoom(t)
+	players := joinPlayers(r, "a", "b", "c")
+	players[0].disconnect()
+
+	// any of the others can be the next host
+	host := players[1].expect(EventTypeHostChanged)[0]["id"]
+	if host != "b" && host != "c" {
+		t.Fatalf("Expected b or c to be the host, got %v", host)
+	}
+	players[2].expect(EventTypeHostChanged)
+
+	for _, p := range players[1:] {
+		if p.ID == host {
+			p.expect(EventTypePlayerUpdated, EventTypePlayersChanged)
+		} else {
+			p.expect(EventTypePlayersChanged)
+		}
+		p.expectNothing()
+	}
+}
+
+func TestPlayerWithSeveralConnections(t *testing.T) {
+	r := newTestRoom(t)
+	players := joinPlayers(r, "a", "b")
+	a, b := players[0], players[1]
+
+	// a second tab catches up on everything a has seen
+	second := r.join("a", "a")
+	second.expect(EventTypeRoomInit, EventTypePlayersChanged, EventTypePlayerJoined, EventTypePlayersChanged)
+
+	b.send(MessageTypeUserToggleReady, MessageUserToggleReady{Ready: true})
+	b.expect(EventTypePlayerUpdated, EventTypePlayersChanged)
+	a.expect(EventTypePlayersChanged)
+	second.expect(EventTypePlayersChanged)
+
+	a.disconnect()
+	b.expectNothing()
+	second.expectNothing()
+
+	second.disconnect()
+	b.expect(EventTypeHostChanged, EventTypePlayerUpdated, EventTypePlayersChanged)
+}
+
+func TestPresence(t *testing.T) {
+	r := newTestRoom(t)
+	players := joinPlayers(r, "a", "b")
+	a, b := players[0], players[1]
+
+	b.send(MessageTypePresence, MessagePresence{Presence: "idle"})
+	for _, p := range players {
+		changed := p.expect(EventTypePlayersChanged)[0]
+		if presence := playerPresence(changed, "b"); presence != "idle" {
+			t.Fatalf("Expected b to be idle, got %q", presence)
+		}
+	}
+
+	// only changes are broadcast
+	b.send(MessageTypePresence, MessagePresence{Presence: "idle"})
+	a.expectNothing()
+	b.expectNothing()
+
+	b.send(MessageTypePresence, MessagePresence{Presence: "away"})
+	b.expectError(ws.ErrorCodeInvalidPayload)
+	a.expectNothing()
+}
+
+func TestPresenceOfSeveralConnections(t *testing.T) {
+	r := newTestRoom(t)
+	players := joinPlayers(r, "a", "b")
+	a, b := players[0], players[1]
+
+	second := r.join("a", "a")
+	second.expect(EventTypeRoomInit, EventTypePlayersChanged, EventTypePlayerJoined, EventTypePlayersChanged)
+
+	// the focused tab keeps a focused
+	second.send(MessageTypePresence, MessagePresence{Presence: "backgrounded"})
+	b.expectNothing()
+
+	a.disconnect()
+	changed := b.expect(EventTypePlayersChanged)[0]
+	if presence := playerPresence(changed, "a"); presence != "backgrounded" {
+		t.Fatalf("Expected a to be backgrounded, got %q", presence)
+	}
+	second.expect(EventTypePlayersChanged)
+}
+
+// playerPresence finds the presence of the player with id in a
+// players_changed event
+func playerPresence(event testEvent, id string) string {
+	players, _ := event["players"].([]any)
+	for _, p := range players {
+		p, _ := p.(map[string]any)
+		if p["id"] == id {
+			presence, _ := p["presence"].(string)
+			return presence
+		}
+	}
+
+	return ""
+}
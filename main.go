@@ -1,11 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -20,19 +31,24 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
 var htmxSerializer = &HtmxSerializer{}
 var jsonSerializer = &JsonSerializer{}
+var msgpackSerializer = &MsgpackSerializer{}
 
-func init() {
-	err := godotenv.Load(".env.local", ".env")
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
+// RoomPage is what the room page is rendered from
+type RoomPage struct {
+	Room
+	UpgradeToken string
 }
 
+const (
+	ProtocolJSON    = "stmsh.json.v1"
+	ProtocolHtmx    = "stmsh.htmx.v1"
+	ProtocolMsgpack = "stmsh.msgpack.v1"
+)
+
 func IgnorePaths(
 	middleware func(http.Handler) http.Handler,
 	skipPrefixes ...string,
@@ -51,8 +67,147 @@ func IgnorePaths(
 	}
 }
 
+// durationEnv reads a time.ParseDuration value, "0" disables a setting
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %s", name, value, err.Error())
+	}
+
+	return d
+}
+
+type Storage struct {
+	Rooms   RoomsRepository
+	Events  RoomEventStore
+	Archive RoomArchive
+}
+
+func NewStorage() Storage {
+	switch storage := os.Getenv("ROOMS_STORAGE"); storage {
+	case "", "memory":
+		return Storage{
+			Rooms:   NewInMemoryRoomsRepository(),
+			Events:  NewInMemoryRoomEventStore(),
+			Archive: NewInMemoryRoomArchive(),
+		}
+
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "stmsh.db"
+		}
+
+		repo, err := NewSQLiteRoomsRepository(path)
+		if err != nil {
+			log.Fatalf("Failed to open sqlite database %q: %s", path, err.Error())
+		}
+		events, err := NewSQLiteRoomEventStore(repo.db)
+		if err != nil {
+			log.Fatalf("Failed to prepare room events table: %s", err.Error())
+		}
+		archive, err := NewSQLiteRoomArchive(repo.db)
+		if err != nil {
+			log.Fatalf("Failed to prepare room archive tables: %s", err.Error())
+		}
+		log.Printf("Using sqlite rooms storage at %s", path)
+
+		return Storage{
+			Rooms:   repo,
+			Events:  events,
+			Archive: archive,
+		}
+
+	default:
+		log.Fatalf("Unknown ROOMS_STORAGE %q", storage)
+		return Storage{}
+	}
+}
+
+// NewBackplane connects this instance to others serving the same rooms.
+// Instances only share room state through sqlite, so a backplane reaching
+// other processes needs it.
+func NewBackplane(storage Storage) ws.Backplane {
+	switch backplane := os.Getenv("BACKPLANE"); backplane {
+	case "", "memory":
+		return ws.NewInProcessBackplane()
+
+	case "tcp":
+		if _, ok := storage.Rooms.(*SQLiteRoomsRepository); !ok {
+			log.Fatal("BACKPLANE=tcp requires ROOMS_STORAGE=sqlite")
+		}
+
+		addr := os.Getenv("BACKPLANE_ADDR")
+		if addr == "" {
+			addr = "127.0.0.1:7070"
+		}
+
+		return ws.NewTCPBackplane(addr)
+
+	default:
+		log.Fatalf("Unknown BACKPLANE %q", backplane)
+		return nil
+	}
+}
+
 func main() {
-	roomsRepository := NewInMemoryRoomsRepository()
+	err := godotenv.Load(".env.local", ".env")
+	if err != nil {
+		log.Fatal("Error loading .env file")
+	}
+
+	storage := NewStorage()
+	roomEvents := storage.Events
+
+	// sqlite keeps rooms across restarts on its own, in-memory rooms are
+	// carried over in a snapshot file
+	var memoryStorage MemoryStorage
+	var isMemoryRooms, isMemoryEvents, isMemoryArchive bool
+	memoryStorage.Rooms, isMemoryRooms = storage.Rooms.(*InMemoryRoomsRepository)
+	memoryStorage.Events, isMemoryEvents = storage.Events.(*InMemoryRoomEventStore)
+	memoryStorage.Archive, isMemoryArchive = storage.Archive.(*InMemoryRoomArchive)
+
+	var snapshotPath string
+	if isMemoryRooms && isMemoryEvents && isMemoryArchive {
+		snapshotPath = os.Getenv("SNAPSHOT_PATH")
+		if snapshotPath == "" {
+			snapshotPath = "snapshot.json"
+		}
+
+		restored, err := LoadSnapshot(snapshotPath, memoryStorage)
+		if err != nil {
+			log.Fatalf("Failed to load snapshot %q: %s", snapshotPath, err.Error())
+		}
+		log.Printf("Restored %d rooms from %s", restored, snapshotPath)
+	}
+
+	instrumentedRooms := NewInstrumentedRoomsRepository(
+		storage.Rooms,
+		durationEnv("SLOW_UPDATE_THRESHOLD", 50*time.Millisecond),
+	)
+	roomsRepository := NewDrainingRoomsRepository(instrumentedRooms)
+	handlers := NewHandlers(roomsRepository, roomEvents, storage.Archive)
+	// instances behind a backplane need the same secret to accept each
+	// other's tokens, and pages opened before a restart need it after
+	upgradeTokenSecret := []byte(os.Getenv("UPGRADE_TOKEN_SECRET"))
+	if len(upgradeTokenSecret) == 0 {
+		path := os.Getenv("UPGRADE_TOKEN_SECRET_PATH")
+		if path == "" {
+			path = "upgrade_token.secret"
+		}
+
+		upgradeTokenSecret, err = LoadUpgradeTokenSecret(path)
+		if err != nil {
+			log.Fatalf("Failed to load upgrade token secret %q: %s", path, err.Error())
+		}
+		log.Printf("UPGRADE_TOKEN_SECRET isn't set, using the secret kept in %s", path)
+	}
+	upgradeTokens := NewUpgradeTokens(upgradeTokenSecret, durationEnv("UPGRADE_TOKEN_TTL", time.Hour))
 
 	r := chi.NewRouter()
 
@@ -85,24 +240,55 @@ func main() {
 
 		r.Post("/first-time", func(w http.ResponseWriter, r *http.Request) {
 			name := r.FormValue("name")
+			if utf8.RuneCountInString(name) > maxPlayerNameLength {
+				fmt.Fprintf(w, "Name can't be longer than %d characters", maxPlayerNameLength)
+				return
+			}
+
 			w.Header().Add("set-cookie", "name="+name)
 			w.Header().Add("hx-redirect", "/")
 		})
 	})
 
 	r.Post("/create", func(w http.ResponseWriter, r *http.Request) {
-		newRoom := NewRoom()
-		roomsRepository.Add(newRoom)
+		newRoom := handlers.CreateRoom()
 
 		w.Header().Add("HX-Redirect", fmt.Sprintf("/room/%s", newRoom.ID))
 		w.Write([]byte(newRoom.ID))
 	})
 
+	r.Get("/history", func(w http.ResponseWriter, r *http.Request) {
+		var history []ArchivedRoom
+		if clientID, err := r.Cookie("clientID"); err == nil {
+			history = storage.Archive.FindByPlayer(clientID.Value)
+		}
+
+		w.Write(t.Render("history.html", history))
+	})
+
+	r.Get("/history.json", func(w http.ResponseWriter, r *http.Request) {
+		history := []ArchivedRoom{}
+		if clientID, err := r.Cookie("clientID"); err == nil {
+			history = append(history, storage.Archive.FindByPlayer(clientID.Value)...)
+		}
+
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(history)
+	})
+
+	r.Get("/metrics/rooms", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(instrumentedRooms.Metrics())
+	})
+
 	r.Get("/room/{id}", func(w http.ResponseWriter, r *http.Request) {
 		roomID := r.PathValue("id")
-		_, err := r.Cookie("clientID")
-		if err != nil {
-			w.Header().Add("set-cookie", "clientID="+uuid.NewString())
+		var clientID string
+		if cookie, err := r.Cookie("clientID"); err == nil {
+			clientID = cookie.Value
+		} else {
+			clientID = uuid.NewString()
+			w.Header().Add("set-cookie", "clientID="+clientID)
 		}
 
 		room := roomsRepository.Find(roomID)
@@ -111,61 +297,297 @@ func main() {
 			return
 		}
 
-		w.Write(t.Render("room", room))
+		token, err := upgradeTokens.Issue(clientID, roomID)
+		if err != nil {
+			log.Printf("Failed to issue upgrade token for %s: %s", clientID, err.Error())
+			http.Error(w, "Failed to open the room, try again", http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(t.Render("room", RoomPage{
+			Room:         *room,
+			UpgradeToken: token,
+		}))
 	})
 
-	handlers := NewHandlers(roomsRepository)
+	r.Get("/room/{id}/replay", HandleRoomReplay(roomEvents))
 
-	manager := ws.NewConnectionManager(handlers.HandleLeave)
-	EnsureRoom := func(handler ws.EventHandler) ws.EventHandler {
-		return func(c *ws.Client, m ws.MessageIncoming) {
-			if c.RoomID == "" {
-				c.ReportError(fmt.Errorf("Join room first"))
-				return
-			}
+	wsOptions := ws.DefaultOptions
+	wsOptions.ResumeGrace = durationEnv("RESUME_GRACE", wsOptions.ResumeGrace)
+	if size := os.Getenv("CLIENT_QUEUE_SIZE"); size != "" {
+		wsOptions.QueueSize, err = strconv.Atoi(size)
+		if err != nil || wsOptions.QueueSize <= 0 {
+			log.Fatalf("Invalid CLIENT_QUEUE_SIZE %q", size)
+		}
+	}
+	if policy := os.Getenv("CLIENT_OVERFLOW_POLICY"); policy != "" {
+		wsOptions.OverflowPolicy, err = ws.ParseOverflowPolicy(policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	wsOptions.RateLimits = ws.RateLimits{
+		ws.AnyMessage:       {Rate: 10, Burst: 20},
+		MessageTypeListAdd:  {Rate: 2, Burst: 10},
+		MessageTypeSetTimer: {Rate: 1, Burst: 3},
+	}
+	if limits := os.Getenv("WS_RATE_LIMITS"); limits != "" {
+		wsOptions.RateLimits, err = ws.ParseRateLimits(limits)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	wsOptions.HandlerTimeout = durationEnv("HANDLER_TIMEOUT", wsOptions.HandlerTimeout)
+	if maxHandlers := os.Getenv("MAX_HANDLERS"); maxHandlers != "" {
+		wsOptions.MaxHandlers, err = strconv.Atoi(maxHandlers)
+		if err != nil || wsOptions.MaxHandlers < 0 {
+			log.Fatalf("Invalid MAX_HANDLERS %q", maxHandlers)
+		}
+	}
+	wsOptions.Backplane = NewBackplane(storage)
+	wsOptions.Codec = NewEventCodec()
+	manager := ws.NewConnectionManager(handlers.HandleLeave, wsOptions)
+
+	serializers := ws.NewSerializerRegistry()
+	serializers.Register(ProtocolJSON, jsonSerializer)
+	serializers.Register(ProtocolHtmx, htmxSerializer)
+	serializers.Register(ProtocolMsgpack, msgpackSerializer)
+	upgrader.Subprotocols = serializers.Protocols()
+	handlerTimings := ws.NewHandlerTimings()
+	manager.Use(
+		ws.Logging(slog.Default()),
+		ws.RateLimiting(),
+		handlerTimings.Middleware(),
+	)
+	handlers.Register(manager)
+
+	r.Get("/ws/messages", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(manager.MessageTypes())
+	})
+
+	r.Get("/metrics/ws", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(manager.RateLimitStats())
+	})
+
+	r.Get("/metrics/handlers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(handlerTimings.Snapshot())
+	})
+
+	checkOrigin := NewOriginChecker(strings.Split(os.Getenv("ALLOWED_ORIGINS"), ","))
+	upgrader.CheckOrigin = checkOrigin
+
+	// authorizeUpgrade consumes the upgrade token of a new websocket or SSE
+	// stream, the room page renders the first one
+	authorizeUpgrade := func(w http.ResponseWriter, r *http.Request) (clientID string, roomID string, ok bool) {
+		query := r.URL.Query()
+		clientID, roomID = query.Get("clientID"), query.Get("room")
+		if !upgradeTokens.Consume(query.Get("token"), clientID, roomID) {
+			http.Error(w, "Invalid or expired upgrade token, reload the page", http.StatusForbidden)
+			return "", "", false
+		}
+
+		return clientID, roomID, true
+	}
 
-			handler(c, m)
+	// replyUpgradeToken hands a new connection the token for its next one
+	replyUpgradeToken := func(client *ws.Client, roomID string) {
+		token, err := upgradeTokens.Issue(client.ID, roomID)
+		if err != nil {
+			log.Printf("Failed to issue upgrade token for %s: %s", client.ID, err.Error())
+			return
 		}
+
+		client.Reply(EventUpgradeToken{Type: EventTypeUpgradeToken, Token: token})
 	}
-	manager.RegisterEventHandler(MessageTypeJoin, handlers.HandleJoin)
-	manager.RegisterEventHandler(MessageTypeUserToggleReady, EnsureRoom(handlers.HandleToggleReady))
-	manager.RegisterEventHandler(MessageTypeNextStage, EnsureRoom(handlers.HandleChangeStage))
-	manager.RegisterEventHandler(MessageTypeSetTimer, EnsureRoom(handlers.HandleSetTimer))
-	manager.RegisterEventHandler(MessageTypeListAdd, EnsureRoom(handlers.HandleListAdd))
-	manager.RegisterEventHandler(MessageTypeListRemove, EnsureRoom(handlers.HandleListRemove))
-	manager.RegisterEventHandler(MessageTypeVote, EnsureRoom(handlers.HandleVote))
 
 	r.Get("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if !checkOrigin(r) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		offered := websocket.Subprotocols(r)
+		if len(offered) > 0 && !serializers.Supports(offered) {
+			http.Error(w, fmt.Sprintf("Supported protocols: %s", strings.Join(serializers.Protocols(), ", ")), http.StatusBadRequest)
+			return
+		}
+
+		clientID, roomID, ok := authorizeUpgrade(w, r)
+		if !ok {
+			return
+		}
+
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Println("Upgrade failed: ", err)
 			return
 		}
 
-		isHtmx := r.URL.Query().Get("htmx") == "true"
-
-		var serializer ws.Serializer
-		if isHtmx {
-			serializer = htmxSerializer
-		} else {
-			serializer = jsonSerializer
+		serializer, ok := serializers.Lookup(conn.Subprotocol())
+		if !ok {
+			// clients from before protocol negotiation
+			if r.URL.Query().Get("htmx") == "true" {
+				serializer = htmxSerializer
+			} else {
+				serializer = jsonSerializer
+			}
 		}
 		client := ws.NewClient(conn, manager, serializer)
-		clientID := r.URL.Query().Get("clientID")
-		if clientID != "" {
-			client.ID = clientID
-		}
+		client.ID = clientID
+		// the token only lets the client into its room
+		client.AuthorizedRoomID = roomID
 
 		manager.AddClient(client)
+		replyUpgradeToken(client, roomID)
 
 		go client.WriteMessages()
 		go client.ReadMessages()
 	})
 
-	go roomsRepository.RunRoomTimer(manager)
-	go roomsRepository.RunRoomCleanup(manager)
+	// SSE carries the same events for clients that can't open a websocket,
+	// their messages are posted to /sse/{stream}
+	sseStreams := ws.NewSSEStreams()
+	r.Get("/sse", func(w http.ResponseWriter, r *http.Request) {
+		if !checkOrigin(r) {
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		protocol := r.URL.Query().Get("protocol")
+		serializer, ok := serializers.Lookup(protocol)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Supported protocols: %s", strings.Join(serializers.Protocols(), ", ")), http.StatusBadRequest)
+			return
+		}
+		if protocol == ProtocolMsgpack {
+			http.Error(w, "Binary protocols aren't available over SSE", http.StatusBadRequest)
+			return
+		}
+
+		clientID, roomID, authorized := authorizeUpgrade(w, r)
+		if !authorized {
+			return
+		}
+
+		conn, err := sseStreams.Open(w, r)
+		if err != nil {
+			log.Printf("in /sse. Failed to open stream: %s", err.Error())
+			return
+		}
+
+		client := ws.NewClient(conn, manager, serializer)
+		client.ID = clientID
+		// the token only lets the client into its room
+		client.AuthorizedRoomID = roomID
+
+		manager.AddClient(client)
+		replyUpgradeToken(client, roomID)
+
+		go client.ReadMessages()
+		// the stream is written until the handler returns
+		client.WriteMessages()
+	})
+
+	r.Post("/sse/{stream}", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		err = sseStreams.Post(r.PathValue("stream"), body)
+		switch {
+		case errors.Is(err, ws.ErrSSEStreamNotFound), errors.Is(err, ws.ErrSSEClosed):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ws.ErrSSEMessageTooBig):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	})
+
+	loopsCtx, stopLoops := context.WithCancel(context.Background())
+	var loops sync.WaitGroup
+	loops.Add(2)
+	go func() {
+		defer loops.Done()
+		RunRoomTimer(loopsCtx, roomsRepository, manager)
+	}()
+	go func() {
+		defer loops.Done()
+		RunRoomCleanup(loopsCtx, roomsRepository, manager, ExpiryPolicy{
+			IdleTTL:           durationEnv("ROOM_IDLE_TTL", DefaultExpiryPolicy.IdleTTL),
+			MaxAge:            durationEnv("ROOM_MAX_AGE", DefaultExpiryPolicy.MaxAge),
+			EmptyGrace:        durationEnv("ROOM_EMPTY_GRACE", DefaultExpiryPolicy.EmptyGrace),
+			FinishedRetention: durationEnv("ROOM_FINISHED_RETENTION", DefaultExpiryPolicy.FinishedRetention),
+			CheckInterval:     durationEnv("ROOM_CLEANUP_INTERVAL", DefaultExpiryPolicy.CheckInterval),
+		})
+	}()
 
-	addr := fmt.Sprintf(":%s", os.Getenv("PORT"))
-	log.Printf("Starting server on http://localhost%s\n", addr)
-	log.Println(http.ListenAndServe(addr, r))
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%s", os.Getenv("PORT")),
+		Handler: r,
+	}
+	log.Printf("Starting server on http://localhost%s\n", server.Addr)
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	// a second signal kills the server right away
+	stop()
+
+	shutdownTimeout := durationEnv("SHUTDOWN_TIMEOUT", 10*time.Second)
+	log.Printf("Shutting down, waiting up to %s", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	stopLoops()
+
+	// Websockets are hijacked, so server.Shutdown doesn't wait for them.
+	// SSE streams are regular requests and end once their clients close.
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.Shutdown(shutdownCtx)
+	}()
+	manager.Shutdown(
+		shutdownCtx,
+		websocket.CloseGoingAway,
+		ws.ReconnectHint(durationEnv("RECONNECT_DELAY", 2*time.Second)),
+	)
+	if err := <-serverDone; err != nil {
+		log.Printf("Failed to stop HTTP server: %s", err.Error())
+	}
+
+	loopsDone := make(chan struct{})
+	go func() {
+		loops.Wait()
+		close(loopsDone)
+	}()
+	select {
+	case <-loopsDone:
+	case <-shutdownCtx.Done():
+		log.Println("Room loops didn't stop in time")
+	}
+
+	if err := roomsRepository.Drain(shutdownCtx); err != nil {
+		log.Printf("Room updates didn't drain in time: %s", err.Error())
+	}
+	wsOptions.Backplane.Close()
+
+	if snapshotPath != "" {
+		if err := SaveSnapshot(snapshotPath, memoryStorage); err != nil {
+			log.Printf("Failed to save snapshot: %s", err.Error())
+		} else {
+			log.Printf("Saved rooms snapshot to %s", snapshotPath)
+		}
+	}
 }
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"stmsh/pkg/ws"
+)
+
+// RequireRoom rejects messages of clients that haven't joined a room
+func RequireRoom(next ws.EventHandler) ws.EventHandler {
+	return func(c *ws.Client, msg ws.MessageIncoming) error {
+		if c.RoomID == "" {
+			return ws.NewError(ErrorCodeNotInRoom, "Join room first")
+		}
+
+		return next(c, msg)
+	}
+}
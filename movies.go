@@ -8,8 +8,8 @@ import (
 )
 
 type TMDBMovie struct {
-	ID          int     `json:"id"`
-	Title       string  `json:"title"`
+	ID          int     `json:"id" validate:"min=1"`
+	Title       string  `json:"title" validate:"required,max=256"`
 	Overview    string  `json:"overview"`
 	Rating      float32 `json:"vote_average"`
 	ReleaseDate string  `json:"release_date"`
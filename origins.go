@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// NewOriginChecker accepts requests from the same host and from allowed
+// origins, written like "https://example.com:8080". Requests without an
+// Origin header don't come from a browser page and are accepted too.
+func NewOriginChecker(allowed []string) func(r *http.Request) bool {
+	origins := make(map[string]bool, len(allowed))
+	for _, origin := range allowed {
+		origin = strings.ToLower(strings.TrimRight(strings.TrimSpace(origin), "/"))
+		if origin != "" {
+			origins[origin] = true
+		}
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		if strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+
+		return origins[strings.ToLower(u.Scheme+"://"+u.Host)]
+	}
+}
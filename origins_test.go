@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOriginChecker(t *testing.T) {
+	checkOrigin := NewOriginChecker(strings.Split(" https://Allowed.example/ ,,http://other.example:8080", ","))
+
+	for _, tc := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{origin: "", allowed: true},
+		{origin: "http://app.example", allowed: true},
+		{origin: "https://APP.example", allowed: true},
+		{origin: "https://allowed.example", allowed: true},
+		{origin: "http://allowed.example"},
+		{origin: "http://other.example:8080", allowed: true},
+		{origin: "http://other.example"},
+		{origin: "https://evil.example"},
+		{origin: "https://app.example.evil.example"},
+		{origin: "://bad"},
+	} {
+		t.Run(tc.origin, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://app.example/ws", nil)
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+
+			if allowed := checkOrigin(r); allowed != tc.allowed {
+				t.Fatalf("Expected allowed to be %v, got %v", tc.allowed, allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Backplane connects connection managers of several nodes sharing the same
+// rooms. Every manager delivers to its own clients and publishes the same
+// delivery for the others.
+type Backplane interface {
+	Publish(e Envelope) error
+	// Subscribe registers a handler for envelopes of every node, the
+	// publishing one included.
+	Subscribe(handler func(Envelope))
+	// Leader reports whether this node should run work that must happen
+	// once across all nodes, like room timers.
+	Leader() bool
+	Close() error
+}
+
+const (
+	EnvelopeBroadcast  = "broadcast"
+	EnvelopeSendTo     = "send_to"
+	EnvelopeDeleteRoom = "delete_room"
+	EnvelopePresence   = "presence"
+	// EnvelopeHeartbeat tells other nodes the publishing one is alive
+	EnvelopeHeartbeat = "heartbeat"
+)
+
+const (
+	heartbeatInterval = 5 * time.Second
+	// heartbeatTimeout is how long a node may be silent before its
+	// clients are taken for gone
+	heartbeatTimeout = 3 * heartbeatInterval
+)
+
+type Envelope struct {
+	Node   string `json:"node"`
+	Kind   string `json:"kind"`
+	RoomID string `json:"room_id"`
+	// ClientID is the recipient of EnvelopeSendTo, the one left out of
+	// EnvelopeBroadcast and the subject of EnvelopePresence
+	ClientID string `json:"client_id,omitempty"`
+	// Present tells whether ClientID joined or left RoomID
+	Present bool `json:"present,omitempty"`
+	// NodeGone marks presence that ended because the node shut down, not
+	// because the player left. The leader calls onLeave then, unless the
+	// player comes back within the resume grace.
+	NodeGone    bool            `json:"node_gone,omitempty"`
+	MessageType string          `json:"message_type,omitempty"`
+	Message     json.RawMessage `json:"message,omitempty"`
+}
+
+// MessageCodec turns outgoing messages into JSON and back into the same Go
+// types on other nodes, so serializers can keep switching on them.
+type MessageCodec struct {
+	lock  *sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+func NewMessageCodec() *MessageCodec {
+	codec := &MessageCodec{
+		lock:  &sync.RWMutex{},
+		types: make(map[string]reflect.Type),
+		names: make(map[reflect.Type]string),
+	}
+	codec.Register(MessageTypeAck, Ack{})
+	codec.Register(MessageTypeError, Error{})
+
+	return codec
+}
+
+// Register makes messages of the same type as prototype known by name
+func (c *MessageCodec) Register(name string, prototype MessageOutgoing) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := reflect.TypeOf(prototype)
+	c.types[name] = t
+	c.names[t] = name
+}
+
+func (c *MessageCodec) Encode(msg MessageOutgoing) (string, json.RawMessage, error) {
+	c.lock.RLock()
+	name, ok := c.names[reflect.TypeOf(msg)]
+	c.lock.RUnlock()
+	if !ok {
+		return "", nil, fmt.Errorf("Message type %T isn't registered", msg)
+	}
+
+	raw, err := json.Marshal(msg)
+
+	return name, raw, err
+}
+
+func (c *MessageCodec) Decode(name string, raw json.RawMessage) (MessageOutgoing, error) {
+	c.lock.RLock()
+	t, ok := c.types[name]
+	c.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Message type %q isn't registered", name)
+	}
+
+	msg := reflect.New(t)
+	if err := json.Unmarshal(raw, msg.Interface()); err != nil {
+		return nil, err
+	}
+
+	return msg.Elem().Interface(), nil
+}
+
+// InProcessBackplane connects managers living in the same process. A single
+// manager with it behaves exactly like one without a backplane.
+type InProcessBackplane struct {
+	lock     *sync.RWMutex
+	handlers []func(Envelope)
+}
+
+func NewInProcessBackplane() *InProcessBackplane {
+	return &InProcessBackplane{
+		lock: &sync.RWMutex{},
+	}
+}
+
+func (b *InProcessBackplane) Publish(e Envelope) error {
+	b.lock.RLock()
+	handlers := b.handlers
+	b.lock.RUnlock()
+
+	for _, handler := range handlers {
+		handler(e)
+	}
+
+	return nil
+}
+
+func (b *InProcessBackplane) Subscribe(handler func(Envelope)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *InProcessBackplane) Leader() bool {
+	return true
+}
+
+func (b *InProcessBackplane) Close() error {
+	return nil
+}
+
+// Leader reports whether this node runs the work that must happen once,
+// which is always the case without a backplane
+func (m *ConnectionManager) Leader() bool {
+	return m.options.Backplane == nil || m.options.Backplane.Leader()
+}
+
+// publish must be called without the manager lock held
+func (m *ConnectionManager) publish(e Envelope, message MessageOutgoing) {
+	if m.options.Backplane == nil {
+		return
+	}
+
+	e.Node = m.node
+	if message != nil {
+		var err error
+		e.MessageType, e.Message, err = m.options.Codec.Encode(message)
+		if err != nil {
+			log.Printf("in publish. Failed to encode message: %s", err.Error())
+			return
+		}
+	}
+
+	if err := m.options.Backplane.Publish(e); err != nil {
+		log.Printf("in publish. Failed to publish %s to room %s: %s", e.Kind, e.RoomID, err.Error())
+	}
+}
+
+func (m *ConnectionManager) publishPresence(roomID string, clientID string, present bool) {
+	m.publish(Envelope{
+		Kind:     EnvelopePresence,
+		RoomID:   roomID,
+		ClientID: clientID,
+		Present:  present,
+	}, nil)
+}
+
+func (m *ConnectionManager) presentElsewhere(roomID string, clientID string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, ok := m.remote[roomID][clientID]
+
+	return ok
+}
+
+// roomPlayer is a player in a room, regardless of their connections
+type roomPlayer struct {
+	roomID   string
+	clientID string
+}
+
+// heartbeat tells other nodes this one is alive and drops the nodes that
+// stopped telling, until Shutdown
+func (m *ConnectionManager) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			m.publish(Envelope{Kind: EnvelopeHeartbeat}, nil)
+			m.dropSilentNodes(now)
+		case <-m.stopped:
+			return
+		}
+	}
+}
+
+// dropSilentNodes forgets the clients of nodes that missed their
+// heartbeats, they crashed or can't be reached
+func (m *ConnectionManager) dropSilentNodes(now time.Time) {
+	var gone []roomPlayer
+
+	m.lock.Lock()
+	for node, seen := range m.nodes {
+		if now.Sub(seen) < heartbeatTimeout {
+			continue
+		}
+		delete(m.nodes, node)
+		log.Printf("in dropSilentNodes. Node %s missed its heartbeats, dropping its clients", node)
+
+		for roomID, clients := range m.remote {
+			for clientID, clientNode := range clients {
+				if clientNode == node {
+					delete(clients, clientID)
+					gone = append(gone, roomPlayer{roomID: roomID, clientID: clientID})
+				}
+			}
+			if len(clients) == 0 {
+				delete(m.remote, roomID)
+			}
+		}
+	}
+	m.lock.Unlock()
+
+	for _, player := range gone {
+		m.abandon(player.roomID, player.clientID)
+	}
+}
+
+// abandon calls onLeave for a player whose node went away, unless the
+// player is back on some node once the resume grace is over. Only the
+// leader calls it, with a stand-in client.
+func (m *ConnectionManager) abandon(roomID string, clientID string) {
+	time.AfterFunc(m.options.ResumeGrace, func() {
+		m.lock.RLock()
+		_, elsewhere := m.remote[roomID][clientID]
+		here := slices.ContainsFunc(m.rooms[roomID], func(c *Client) bool {
+			return c.ID == clientID
+		})
+		back := m.closing || elsewhere || here
+		m.lock.RUnlock()
+
+		if back || !m.Leader() {
+			return
+		}
+		m.onLeave(&Client{ID: clientID, RoomID: roomID, Manager: m})
+	})
+}
+
+// receive handles envelopes of other nodes
+func (m *ConnectionManager) receive(e Envelope) {
+	if e.Node == m.node {
+		return
+	}
+
+	m.lock.Lock()
+	m.nodes[e.Node] = time.Now()
+	m.lock.Unlock()
+
+	switch e.Kind {
+	case EnvelopeBroadcast, EnvelopeSendTo:
+		message, err := m.options.Codec.Decode(e.MessageType, e.Message)
+		if err != nil {
+			log.Printf("in receive. Failed to decode %s message: %s", e.MessageType, err.Error())
+			return
+		}
+
+		if e.Kind == EnvelopeSendTo {
+			m.deliver(e.RoomID, e.ClientID, "", message)
+		} else {
+			m.deliver(e.RoomID, "", e.ClientID, message)
+		}
+
+	case EnvelopeDeleteRoom:
+		m.deleteRoom(e.RoomID)
+
+	case EnvelopePresence:
+		m.lock.Lock()
+		clients := m.remote[e.RoomID]
+		gone := false
+		if e.Present {
+			if clients == nil {
+				clients = make(map[string]string)
+				m.remote[e.RoomID] = clients
+			}
+			clients[e.ClientID] = e.Node
+		} else if clients[e.ClientID] == e.Node {
+			delete(clients, e.ClientID)
+			if len(clients) == 0 {
+				delete(m.remote, e.RoomID)
+			}
+			gone = e.NodeGone
+		}
+		m.lock.Unlock()
+
+		if gone {
+			m.abandon(e.RoomID, e.ClientID)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package ws
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	backplaneWriteWait  = 5 * time.Second
+	backplaneRetryDelay = time.Second
+)
+
+// TCPBackplane is a small broker for nodes on the same network. The first
+// node to bind the address becomes the broker and the leader, the others
+// connect to it. When the broker goes away the remaining nodes race to
+// take its place. Envelopes are newline separated JSON.
+type TCPBackplane struct {
+	addr string
+
+	lock     *sync.RWMutex
+	handlers []func(Envelope)
+	// peers are the connected nodes while this node is the broker,
+	// otherwise the only peer is the broker
+	peers  map[net.Conn]*sync.Mutex
+	leader atomic.Bool
+	closed atomic.Bool
+
+	listener net.Listener
+}
+
+func NewTCPBackplane(addr string) *TCPBackplane {
+	b := &TCPBackplane{
+		addr:  addr,
+		lock:  &sync.RWMutex{},
+		peers: make(map[net.Conn]*sync.Mutex),
+	}
+	go b.run()
+
+	return b
+}
+
+func (b *TCPBackplane) run() {
+	for !b.closed.Load() {
+		listener, err := net.Listen("tcp", b.addr)
+		if err == nil {
+			b.serve(listener)
+			continue
+		}
+
+		conn, err := net.Dial("tcp", b.addr)
+		if err != nil {
+			log.Printf("in TCPBackplane. Failed to reach broker at %s: %s", b.addr, err.Error())
+			time.Sleep(backplaneRetryDelay)
+			continue
+		}
+
+		log.Printf("Connected to backplane broker at %s", b.addr)
+		b.addPeer(conn)
+		b.read(conn, false)
+		time.Sleep(backplaneRetryDelay)
+	}
+}
+
+func (b *TCPBackplane) serve(listener net.Listener) {
+	log.Printf("Backplane broker listening on %s", b.addr)
+	b.lock.Lock()
+	b.listener = listener
+	b.lock.Unlock()
+	b.leader.Store(true)
+	defer b.leader.Store(false)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("in TCPBackplane. Failed to accept: %s", err.Error())
+			}
+			return
+		}
+
+		b.addPeer(conn)
+		go b.read(conn, true)
+	}
+}
+
+// read delivers envelopes from conn until it fails. The broker also passes
+// them on to every other node.
+func (b *TCPBackplane) read(conn net.Conn, forward bool) {
+	defer b.removePeer(conn)
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var e Envelope
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("in TCPBackplane. Malformed envelope: %s", err.Error())
+			continue
+		}
+
+		if forward {
+			b.write(scanner.Bytes(), conn)
+		}
+		b.deliver(e)
+	}
+}
+
+func (b *TCPBackplane) Publish(e Envelope) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	b.deliver(e)
+	if sent := b.write(raw, nil); sent == 0 && !b.leader.Load() {
+		return fmt.Errorf("Not connected to the backplane broker")
+	}
+
+	return nil
+}
+
+// write sends raw to every peer except skip and returns how many got it
+func (b *TCPBackplane) write(raw []byte, skip net.Conn) int {
+	b.lock.RLock()
+	peers := make(map[net.Conn]*sync.Mutex, len(b.peers))
+	for conn, lock := range b.peers {
+		if conn != skip {
+			peers[conn] = lock
+		}
+	}
+	b.lock.RUnlock()
+
+	line := append(raw[:len(raw):len(raw)], '\n')
+	sent := 0
+	for conn, lock := range peers {
+		lock.Lock()
+		conn.SetWriteDeadline(time.Now().Add(backplaneWriteWait))
+		_, err := conn.Write(line)
+		lock.Unlock()
+
+		if err != nil {
+			log.Printf("in TCPBackplane. Dropping peer %s: %s", conn.RemoteAddr(), err.Error())
+			conn.Close()
+			continue
+		}
+		sent++
+	}
+
+	return sent
+}
+
+func (b *TCPBackplane) deliver(e Envelope) {
+	b.lock.RLock()
+	handlers := b.handlers
+	b.lock.RUnlock()
+
+	for _, handler := range handlers {
+		handler(e)
+	}
+}
+
+func (b *TCPBackplane) addPeer(conn net.Conn) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.peers[conn] = &sync.Mutex{}
+}
+
+func (b *TCPBackplane) removePeer(conn net.Conn) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.peers, conn)
+	conn.Close()
+}
+
+func (b *TCPBackplane) Subscribe(handler func(Envelope)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *TCPBackplane) Leader() bool {
+	return b.leader.Load()
+}
+
+func (b *TCPBackplane) Close() error {
+	b.closed.Store(true)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.listener != nil {
+		b.listener.Close()
+	}
+	for conn := range b.peers {
+		conn.Close()
+	}
+
+	return nil
+}
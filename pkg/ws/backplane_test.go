@@ -0,0 +1,66 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testSerializer writes every message as a JSON text frame
+type testSerializer struct{}
+
+func (testSerializer) Serialize(seq int, msg MessageOutgoing) (int, [][]byte) {
+	raw, _ := json.Marshal(msg)
+	return websocket.TextMessage, [][]byte{raw}
+}
+
+func newTestNodes(t *testing.T, onLeave func(c *Client)) (*ConnectionManager, *ConnectionManager) {
+	t.Helper()
+
+	options := DefaultOptions
+	options.ResumeGrace = 10 * time.Millisecond
+	options.Backplane = NewInProcessBackplane()
+	options.Codec = NewMessageCodec()
+
+	leader := NewConnectionManager(onLeave, options)
+	other := NewConnectionManager(onLeave, options)
+	t.Cleanup(func() {
+		leader.Shutdown(context.Background(), websocket.CloseGoingAway, "")
+	})
+
+	return leader, other
+}
+
+func TestShutdownTellsOtherNodes(t *testing.T) {
+	left := make(chan *Client, 1)
+	leader, stopping := newTestNodes(t, func(c *Client) { left <- c })
+
+	c := NewClient(NewMemoryConn(), stopping, testSerializer{})
+	c.ID = "a"
+	stopping.AddClient(c)
+	stopping.AssignRoom(c, "room")
+	go c.WriteMessages()
+
+	if !leader.presentElsewhere("room", "a") {
+		t.Fatal("Expected a to be known by the other node")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	stopping.Shutdown(ctx, websocket.CloseGoingAway, "")
+
+	if leader.presentElsewhere("room", "a") {
+		t.Fatal("Expected a to be gone once its node shut down")
+	}
+	select {
+	case c := <-left:
+		if c.ID != "a" || c.RoomID != "room" {
+			t.Fatalf("Expected a to leave room, got %s leaving %s", c.ID, c.RoomID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the leader to let a leave")
+	}
+}
@@ -0,0 +1,16 @@
+package ws
+
+import "time"
+
+// Conn is the transport of a client. *websocket.Conn implements it, other
+// transports mimic websocket frames: message types are the websocket ones
+// and close messages are formatted with websocket.FormatCloseMessage.
+type Conn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	SetReadLimit(limit int64)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetPongHandler(h func(appData string) error)
+	Close() error
+}
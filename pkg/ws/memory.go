@@ -0,0 +1,171 @@
+package ws
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrMemoryConnClosed  = errors.New("Connection is closed")
+	ErrMemoryConnTimeout = errors.New("Timed out waiting for a frame")
+)
+
+// Frame is a websocket frame written to a MemoryConn
+type Frame struct {
+	Type int
+	Data []byte
+}
+
+// MemoryConn is a Conn that never leaves the process, for driving clients
+// from tests. The server reads and writes it like any Conn, the other end
+// sends messages with Send and reads what the server wrote with Receive.
+// Closing it from either end ends ReadMessage.
+type MemoryConn struct {
+	incoming  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	lock sync.Mutex
+	// written has a value whenever a frame was written since the last
+	// Receive
+	written     chan struct{}
+	outgoing    []Frame
+	readLimit   int64
+	pongHandler func(appData string) error
+}
+
+func NewMemoryConn() *MemoryConn {
+	return &MemoryConn{
+		incoming: make(chan []byte, 16),
+		closed:   make(chan struct{}),
+		written:  make(chan struct{}, 1),
+	}
+}
+
+func (c *MemoryConn) ReadMessage() (int, []byte, error) {
+	select {
+	case data := <-c.incoming:
+		c.lock.Lock()
+		limit := c.readLimit
+		c.lock.Unlock()
+		if limit > 0 && int64(len(data)) > limit {
+			c.Close()
+			return 0, nil, websocket.ErrReadLimit
+		}
+
+		return websocket.TextMessage, data, nil
+	case <-c.closed:
+		return 0, nil, ErrMemoryConnClosed
+	}
+}
+
+func (c *MemoryConn) WriteMessage(messageType int, data []byte) error {
+	select {
+	case <-c.closed:
+		return ErrMemoryConnClosed
+	default:
+	}
+
+	c.lock.Lock()
+	c.outgoing = append(c.outgoing, Frame{Type: messageType, Data: data})
+	c.lock.Unlock()
+
+	select {
+	case c.written <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (c *MemoryConn) SetReadLimit(limit int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readLimit = limit
+}
+
+// SetReadDeadline does nothing, a MemoryConn is read until it's closed
+func (c *MemoryConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes never block
+func (c *MemoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *MemoryConn) SetPongHandler(h func(appData string) error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.pongHandler = h
+}
+
+func (c *MemoryConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+
+	return nil
+}
+
+// Send hands data to the server as a text frame
+func (c *MemoryConn) Send(data []byte) error {
+	select {
+	case c.incoming <- data:
+		return nil
+	case <-c.closed:
+		return ErrMemoryConnClosed
+	}
+}
+
+// Pong answers a ping like a browser would
+func (c *MemoryConn) Pong() error {
+	c.lock.Lock()
+	h := c.pongHandler
+	c.lock.Unlock()
+
+	if h == nil {
+		return nil
+	}
+
+	return h("")
+}
+
+// Receive returns the oldest frame the server wrote that wasn't received
+// yet, waiting up to timeout for one. Frames written before the
+// connection closed can still be received.
+func (c *MemoryConn) Receive(timeout time.Duration) (Frame, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		c.lock.Lock()
+		if len(c.outgoing) > 0 {
+			frame := c.outgoing[0]
+			c.outgoing = c.outgoing[1:]
+			c.lock.Unlock()
+
+			return frame, nil
+		}
+		c.lock.Unlock()
+
+		select {
+		case <-c.written:
+		case <-c.closed:
+			// the last frames may have been written right before
+			c.lock.Lock()
+			empty := len(c.outgoing) == 0
+			c.lock.Unlock()
+			if empty {
+				return Frame{}, ErrMemoryConnClosed
+			}
+		case <-timer.C:
+			return Frame{}, ErrMemoryConnTimeout
+		}
+	}
+}
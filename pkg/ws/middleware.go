@@ -0,0 +1,203 @@
+package ws
+
+import (
+	"errors"
+	"log"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Middleware wraps an EventHandler, to act before or after it or instead
+// of it
+type Middleware func(next EventHandler) EventHandler
+
+// errDropped is returned by middleware that ignores a message without
+// telling the client, it's neither acked nor reported
+var errDropped = errors.New("Message dropped")
+
+// Chain wraps handler in middleware, the first one is the outermost
+func Chain(handler EventHandler, middleware ...Middleware) EventHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return handler
+}
+
+func unknownMessage(c *Client, msg MessageIncoming) error {
+	log.Printf("in handleMessage. Unhandled message type %q", msg.Type)
+	return NewError(ErrorCodeUnknownMessage, "Unknown message type %q", msg.Type)
+}
+
+// safeCall turns a panic of handler into an internal error
+func safeCall(handler EventHandler, c *Client, msg MessageIncoming) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("in handleMessage. Handler of %q panicked: %v\n%s", msg.Type, r, debug.Stack())
+			err = NewError(ErrorCodeInternal, "Something went wrong")
+		}
+	}()
+
+	return handler(c, msg)
+}
+
+// SetHandlerTimeout overrides Options.HandlerTimeout for messages of type
+// event, 0 waits forever
+func (m *ConnectionManager) SetHandlerTimeout(event string, timeout time.Duration) {
+	m.timeouts[event] = timeout
+}
+
+// isolate runs handler on its own goroutine and gives up waiting for it
+// after the timeout of event, so the client hears back in time. Go can't
+// stop a goroutine, a handler that timed out keeps running, and the
+// client's next message waits for it: messages of a client are always
+// handled one at a time and in order. At most Options.MaxHandlers
+// handlers run at once, waiting for a free slot counts towards the timeout.
+func (m *ConnectionManager) isolate(event string, handler EventHandler) EventHandler {
+	timeout, ok := m.timeouts[event]
+	if !ok {
+		timeout = m.options.HandlerTimeout
+	}
+	if timeout <= 0 {
+		return handler
+	}
+
+	return func(c *Client, msg MessageIncoming) error {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		if m.handlerSlots != nil {
+			select {
+			case m.handlerSlots <- struct{}{}:
+			case <-timer.C:
+				log.Printf("in handleMessage. No free handler slot for %q of client %s after %s", msg.Type, c.ID, timeout)
+				return NewError(ErrorCodeTimeout, "Server is busy, try again in a moment")
+			}
+		}
+
+		result := make(chan error, 1)
+		go func() {
+			if m.handlerSlots != nil {
+				defer func() { <-m.handlerSlots }()
+			}
+			result <- safeCall(handler, c, msg)
+		}()
+
+		select {
+		case err := <-result:
+			return err
+		case <-timer.C:
+			log.Printf("in handleMessage. Handler of %q for client %s timed out after %s", msg.Type, c.ID, timeout)
+			c.pending = result
+			return NewError(ErrorCodeTimeout, "Message took too long, it may still be applied")
+		}
+	}
+}
+
+// awaitHandler blocks until a handler of c that timed out has returned.
+// It's only called on the read loop.
+func (c *Client) awaitHandler() {
+	if c.pending == nil {
+		return
+	}
+
+	<-c.pending
+	c.pending = nil
+}
+
+// Logging logs every handled message with its outcome
+func Logging(logger *slog.Logger) Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(c *Client, msg MessageIncoming) error {
+			start := time.Now()
+			err := next(c, msg)
+
+			attrs := []any{
+				slog.String("type", msg.Type),
+				slog.String("client", c.ID),
+				slog.String("room", c.RoomID),
+				slog.Duration("duration", time.Since(start)),
+			}
+			if msg.ID != "" {
+				attrs = append(attrs, slog.String("id", msg.ID))
+			}
+
+			switch {
+			case errors.Is(err, errDropped):
+				logger.Debug("ws message dropped", attrs...)
+			case err != nil:
+				code := ErrorCodeInternal
+				var wsErr Error
+				if errors.As(err, &wsErr) {
+					code = wsErr.Code
+				}
+				attrs = append(attrs, slog.String("code", code), slog.String("error", err.Error()))
+				logger.Warn("ws message failed", attrs...)
+			default:
+				logger.Info("ws message", attrs...)
+			}
+
+			return err
+		}
+	}
+}
+
+// HandlerTiming is how long handlers of a message type took
+type HandlerTiming struct {
+	Calls  int64         `json:"calls"`
+	Errors int64         `json:"errors"`
+	Total  time.Duration `json:"total"`
+	Max    time.Duration `json:"max"`
+}
+
+// HandlerTimings collects HandlerTiming by message type through its
+// Middleware
+type HandlerTimings struct {
+	lock    *sync.Mutex
+	timings map[string]HandlerTiming
+}
+
+func NewHandlerTimings() *HandlerTimings {
+	return &HandlerTimings{
+		lock:    &sync.Mutex{},
+		timings: make(map[string]HandlerTiming),
+	}
+}
+
+func (t *HandlerTimings) Middleware() Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(c *Client, msg MessageIncoming) error {
+			start := time.Now()
+			err := next(c, msg)
+			elapsed := time.Since(start)
+
+			t.lock.Lock()
+			defer t.lock.Unlock()
+
+			timing := t.timings[msg.Type]
+			timing.Calls++
+			if err != nil && !errors.Is(err, errDropped) {
+				timing.Errors++
+			}
+			timing.Total += elapsed
+			timing.Max = max(timing.Max, elapsed)
+			t.timings[msg.Type] = timing
+
+			return err
+		}
+	}
+}
+
+func (t *HandlerTimings) Snapshot() map[string]HandlerTiming {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	snapshot := make(map[string]HandlerTiming, len(t.timings))
+	for messageType, timing := range t.timings {
+		snapshot[messageType] = timing
+	}
+
+	return snapshot
+}
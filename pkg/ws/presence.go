@@ -0,0 +1,141 @@
+package ws
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// pongTimeout is how long a pong may take before the connection counts as
+// away. SSE streams have no pongs, a ping they could write counts as one.
+const pongTimeout = 10 * time.Second
+
+// Presence tells whether a player is looking at the room. Clients report
+// the first three, away is inferred from late pongs and disconnects.
+type Presence string
+
+const (
+	PresenceFocused      Presence = "focused"
+	PresenceBackgrounded Presence = "backgrounded"
+	PresenceIdle         Presence = "idle"
+	PresenceAway         Presence = "away"
+)
+
+// presenceOrder goes from the most to the least present
+var presenceOrder = []Presence{PresenceFocused, PresenceBackgrounded, PresenceIdle, PresenceAway}
+
+// ParseReportedPresence accepts the states clients can report
+func ParseReportedPresence(s string) (Presence, error) {
+	switch presence := Presence(s); presence {
+	case PresenceFocused, PresenceBackgrounded, PresenceIdle:
+		return presence, nil
+	default:
+		return "", fmt.Errorf("Unknown presence %q", s)
+	}
+}
+
+// SetPresenceHandler sets what's called when the presence of a player in a
+// room changes. A player is as present as their most present connection.
+// The handler runs on its own goroutine, away from the connections: c is a
+// stand-in with only ID, RoomID and Manager set, and quick changes may be
+// reported once with the latest presence.
+func (m *ConnectionManager) SetPresenceHandler(handler func(c *Client, presence Presence)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.onPresence == nil {
+		go m.notifyPresence()
+	}
+	m.onPresence = handler
+}
+
+// SetPresence records the presence the client reported
+func (c *Client) SetPresence(presence Presence) {
+	m := c.Manager
+
+	m.lock.Lock()
+	c.presence = presence
+	m.lock.Unlock()
+
+	m.updatePresence(c)
+}
+
+// setResponsive marks c away while it's late answering pings
+func (m *ConnectionManager) setResponsive(c *Client, responsive bool) {
+	m.lock.Lock()
+	if c.responsive == responsive {
+		m.lock.Unlock()
+		return
+	}
+	c.responsive = responsive
+	m.lock.Unlock()
+
+	m.updatePresence(c)
+}
+
+// updatePresence works out the presence of c's player and hands it to the
+// presence handler if it changed. It must be called without the lock held.
+func (m *ConnectionManager) updatePresence(c *Client) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	presence, ok := m.playerPresence(c.RoomID, c.ID)
+	// presence isn't tracked any more while shutting down
+	if !ok || m.closing || c.session.presence == presence {
+		return
+	}
+	c.session.presence = presence
+
+	if m.onPresence == nil {
+		return
+	}
+	m.presenceChanges[roomPlayer{roomID: c.RoomID, clientID: c.ID}] = presence
+	select {
+	case m.presenceChanged <- struct{}{}:
+	default:
+	}
+}
+
+// notifyPresence calls the presence handler with changes handed over by
+// updatePresence, until Shutdown
+func (m *ConnectionManager) notifyPresence() {
+	for {
+		select {
+		case <-m.presenceChanged:
+		case <-m.stopped:
+			return
+		}
+
+		m.lock.Lock()
+		changes := m.presenceChanges
+		m.presenceChanges = make(map[roomPlayer]Presence)
+		onPresence := m.onPresence
+		m.lock.Unlock()
+
+		for player, presence := range changes {
+			onPresence(&Client{ID: player.clientID, RoomID: player.roomID, Manager: m}, presence)
+		}
+	}
+}
+
+// playerPresence must be called with the lock held. It reports false if
+// the player isn't in the room anymore, connections waiting to be resumed
+// count as away.
+func (m *ConnectionManager) playerPresence(roomID string, clientID string) (Presence, bool) {
+	presence, found := PresenceAway, false
+	for _, c := range m.rooms[roomID] {
+		if c.ID != clientID {
+			continue
+		}
+		found = true
+
+		if c.closed || !c.responsive {
+			continue
+		}
+		if slices.Index(presenceOrder, c.presence) < slices.Index(presenceOrder, presence) {
+			presence = c.presence
+		}
+	}
+
+	return presence, found
+}
@@ -0,0 +1,63 @@
+package ws
+
+import (
+	"slices"
+	"sync"
+)
+
+// SerializerRegistry maps websocket subprotocols to serializers. Protocol
+// names carry a version, so a breaking change to the wire format ships as a
+// new protocol while older clients keep the one they asked for.
+type SerializerRegistry struct {
+	lock        *sync.RWMutex
+	protocols   []string
+	serializers map[string]Serializer
+}
+
+func NewSerializerRegistry() *SerializerRegistry {
+	return &SerializerRegistry{
+		lock:        &sync.RWMutex{},
+		serializers: make(map[string]Serializer),
+	}
+}
+
+// Register adds a protocol. Protocols registered first are preferred when a
+// client offers several.
+func (r *SerializerRegistry) Register(protocol string, serializer Serializer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.serializers[protocol]; !ok {
+		r.protocols = append(r.protocols, protocol)
+	}
+	r.serializers[protocol] = serializer
+}
+
+// Protocols lists registered protocols in order of preference, it's meant
+// for websocket.Upgrader.Subprotocols
+func (r *SerializerRegistry) Protocols() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return slices.Clone(r.protocols)
+}
+
+func (r *SerializerRegistry) Lookup(protocol string) (Serializer, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	serializer, ok := r.serializers[protocol]
+
+	return serializer, ok
+}
+
+// Supports reports whether any of the offered protocols is registered
+func (r *SerializerRegistry) Supports(offered []string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return slices.ContainsFunc(offered, func(protocol string) bool {
+		_, ok := r.serializers[protocol]
+		return ok
+	})
+}
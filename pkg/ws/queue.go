@@ -0,0 +1,145 @@
+package ws
+
+import (
+	"fmt"
+	"sync"
+)
+
+// OverflowPolicy decides what happens when a client's outbound queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest discards the oldest queued message
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowCoalesce keeps only the latest of queued messages sharing a
+	// CoalesceKey and evicts the client if that doesn't free any space
+	OverflowCoalesce OverflowPolicy = "coalesce"
+	// OverflowDisconnect evicts the client
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(s); policy {
+	case OverflowDropOldest, OverflowCoalesce, OverflowDisconnect:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("Unknown overflow policy %q", s)
+	}
+}
+
+// Coalescable messages carry state that replaces any older message with
+// the same key, so only the latest one needs to be delivered.
+type Coalescable interface {
+	CoalesceKey() string
+}
+
+// queue is a bounded outbound queue. Pushing never blocks, so senders
+// holding locks can't be held up by a slow connection.
+type queue struct {
+	lock     sync.Mutex
+	messages []Sequenced
+	size     int
+	policy   OverflowPolicy
+	// ready has a value whenever there's something for the writer to do
+	ready chan struct{}
+
+	closed  bool
+	evicted bool
+}
+
+func newQueue(size int, policy OverflowPolicy) *queue {
+	return &queue{
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+func (q *queue) push(msg Sequenced) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	if len(q.messages) >= q.size {
+		switch q.policy {
+		case OverflowDropOldest:
+			q.messages = q.messages[1:]
+
+		case OverflowCoalesce:
+			q.coalesce(msg)
+			if len(q.messages) >= q.size {
+				q.evict()
+				return
+			}
+
+		default:
+			q.evict()
+			return
+		}
+	}
+
+	q.messages = append(q.messages, msg)
+	q.notify()
+}
+
+// coalesce drops queued messages superseded by a later one, msg included
+func (q *queue) coalesce(msg Sequenced) {
+	latest := make(map[string]int)
+	for i, queued := range q.messages {
+		if c, ok := queued.Message.(Coalescable); ok {
+			latest[c.CoalesceKey()] = i
+		}
+	}
+	if c, ok := msg.Message.(Coalescable); ok {
+		latest[c.CoalesceKey()] = len(q.messages)
+	}
+
+	kept := q.messages[:0]
+	for i, queued := range q.messages {
+		if c, ok := queued.Message.(Coalescable); ok && latest[c.CoalesceKey()] != i {
+			continue
+		}
+		kept = append(kept, queued)
+	}
+	clear(q.messages[len(kept):])
+	q.messages = kept
+}
+
+// evict must be called with the lock held
+func (q *queue) evict() {
+	q.evicted = true
+	q.closed = true
+	q.messages = nil
+	q.notify()
+}
+
+// close stops accepting messages, the ones already queued are still sent
+func (q *queue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.notify()
+}
+
+// pop returns everything queued. done is set once the queue is closed and
+// drained, evicted tells why.
+func (q *queue) pop() (messages []Sequenced, done bool, evicted bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	messages = q.messages
+	q.messages = nil
+
+	return messages, q.closed, q.evicted
+}
+
+func (q *queue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
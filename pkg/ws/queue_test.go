@@ -0,0 +1,103 @@
+package ws
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testState replaces any older testState with the same key
+type testState struct {
+	Key   string
+	Value int
+}
+
+func (s testState) CoalesceKey() string { return s.Key }
+
+func fill(q *queue, messages ...MessageOutgoing) {
+	for i, msg := range messages {
+		q.push(Sequenced{Seq: i + 1, Message: msg})
+	}
+}
+
+func popped(q *queue) ([]MessageOutgoing, bool) {
+	sequenced, _, evicted := q.pop()
+	var messages []MessageOutgoing
+	for _, s := range sequenced {
+		messages = append(messages, s.Message)
+	}
+
+	return messages, evicted
+}
+
+func TestQueueOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   OverflowPolicy
+		pushed   []MessageOutgoing
+		expected []MessageOutgoing
+		evicted  bool
+	}{
+		{
+			name:     "fits",
+			policy:   OverflowDisconnect,
+			pushed:   []MessageOutgoing{"a", "b", "c"},
+			expected: []MessageOutgoing{"a", "b", "c"},
+		},
+		{
+			name:     "drop oldest",
+			policy:   OverflowDropOldest,
+			pushed:   []MessageOutgoing{"a", "b", "c", "d", "e"},
+			expected: []MessageOutgoing{"c", "d", "e"},
+		},
+		{
+			name:   "coalesce",
+			policy: OverflowCoalesce,
+			pushed: []MessageOutgoing{
+				testState{"time", 1}, "chat", testState{"players", 1},
+				testState{"time", 2}, testState{"players", 2},
+			},
+			expected: []MessageOutgoing{"chat", testState{"time", 2}, testState{"players", 2}},
+		},
+		{
+			name:    "coalesce without anything to coalesce",
+			policy:  OverflowCoalesce,
+			pushed:  []MessageOutgoing{testState{"time", 1}, "chat", testState{"players", 1}, "chat"},
+			evicted: true,
+		},
+		{
+			name:    "disconnect",
+			policy:  OverflowDisconnect,
+			pushed:  []MessageOutgoing{"a", "b", "c", "d"},
+			evicted: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := newQueue(3, tc.policy)
+			fill(q, tc.pushed...)
+
+			messages, evicted := popped(q)
+			if evicted != tc.evicted {
+				t.Fatalf("Expected evicted to be %v, got %v", tc.evicted, evicted)
+			}
+			if !reflect.DeepEqual(messages, tc.expected) {
+				t.Fatalf("Expected %v, got %v", tc.expected, messages)
+			}
+		})
+	}
+}
+
+func TestQueueEvictedIgnoresPushes(t *testing.T) {
+	q := newQueue(1, OverflowDisconnect)
+	fill(q, "a", "b")
+	q.push(Sequenced{Seq: 3, Message: "c"})
+
+	messages, done, evicted := q.pop()
+	if !done || !evicted || len(messages) != 0 {
+		t.Fatalf("Expected an evicted queue to stay empty, got %v", messages)
+	}
+	select {
+	case <-q.ready:
+	default:
+		t.Fatal("Expected the writer to be woken up to disconnect")
+	}
+}
@@ -0,0 +1,250 @@
+package ws
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrorCodeRateLimited is sent for messages dropped by the rate limiter
+const ErrorCodeRateLimited = "rate_limited"
+
+// AnyMessage is the RateLimits key for the limit on all messages of a client
+const AnyMessage = "*"
+
+// RateLimit is a token bucket: Burst messages at once, refilled at Rate
+// messages per second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits maps message types to their limit, AnyMessage applies to all
+// messages of a client together.
+type RateLimits map[string]RateLimit
+
+// ParseRateLimits reads limits written as "type=rate:burst,...", for example
+// "*=10:20,list_add=2:10".
+func ParseRateLimits(s string) (RateLimits, error) {
+	limits := make(RateLimits)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		messageType, limit, ok := strings.Cut(entry, "=")
+		rate, burst, ok2 := strings.Cut(limit, ":")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("Invalid rate limit %q, expected type=rate:burst", entry)
+		}
+
+		var l RateLimit
+		var err error
+		if l.Rate, err = strconv.ParseFloat(rate, 64); err != nil || l.Rate <= 0 {
+			return nil, fmt.Errorf("Invalid rate in %q", entry)
+		}
+		if l.Burst, err = strconv.Atoi(burst); err != nil || l.Burst <= 0 {
+			return nil, fmt.Errorf("Invalid burst in %q", entry)
+		}
+		limits[messageType] = l
+	}
+
+	return limits, nil
+}
+
+// Escalation decides how clients that keep hitting the limits are treated.
+// Every dropped message is a violation, violations are forgotten after
+// Window without any.
+type Escalation struct {
+	MuteAfter       int
+	MuteFor         time.Duration
+	DisconnectAfter int
+	Window          time.Duration
+}
+
+type bucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(limit RateLimit, now time.Time) *bucket {
+	return &bucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   now,
+	}
+}
+
+func (b *bucket) allow(now time.Time) bool {
+	b.tokens = min(
+		float64(b.limit.Burst),
+		b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate,
+	)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+type verdict int
+
+const (
+	verdictAllow verdict = iota
+	verdictThrottle
+	verdictMute
+	// verdictMuted drops the message without telling the client again
+	verdictMuted
+	verdictDisconnect
+)
+
+// limiter is only used on a client's read loop, so it isn't locked
+type limiter struct {
+	limits     RateLimits
+	escalation Escalation
+	buckets    map[string]*bucket
+
+	violations    int
+	lastViolation time.Time
+	mutedUntil    time.Time
+}
+
+func newLimiter(limits RateLimits, escalation Escalation) *limiter {
+	return &limiter{
+		limits:     limits,
+		escalation: escalation,
+		buckets:    make(map[string]*bucket),
+	}
+}
+
+func (l *limiter) check(messageType string, now time.Time) verdict {
+	if len(l.limits) == 0 {
+		return verdictAllow
+	}
+
+	if l.escalation.Window > 0 && now.Sub(l.lastViolation) > l.escalation.Window {
+		l.violations = 0
+	}
+
+	muted := now.Before(l.mutedUntil)
+	if !muted && l.take(AnyMessage, now) && l.take(messageType, now) {
+		return verdictAllow
+	}
+
+	l.violations++
+	l.lastViolation = now
+
+	switch {
+	case l.escalation.DisconnectAfter > 0 && l.violations >= l.escalation.DisconnectAfter:
+		return verdictDisconnect
+	case muted:
+		return verdictMuted
+	case l.escalation.MuteAfter > 0 && l.violations >= l.escalation.MuteAfter:
+		l.mutedUntil = now.Add(l.escalation.MuteFor)
+		return verdictMute
+	default:
+		return verdictThrottle
+	}
+}
+
+func (l *limiter) take(key string, now time.Time) bool {
+	limit, ok := l.limits[key]
+	if !ok {
+		return true
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newBucket(limit, now)
+		l.buckets[key] = b
+	}
+
+	return b.allow(now)
+}
+
+// RateLimiting applies Options.RateLimits and Options.Escalation. Clients
+// are told about dropped messages until they're muted, and kicked once
+// they keep going.
+func RateLimiting() Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(c *Client, msg MessageIncoming) error {
+			verdict := c.limiter.check(msg.Type, time.Now())
+			if verdict != verdictAllow {
+				c.Manager.rateLimits.record(msg.Type, verdict)
+			}
+
+			switch verdict {
+			case verdictThrottle:
+				return NewError(ErrorCodeRateLimited, "Too many messages, slow down")
+
+			case verdictMute:
+				return NewError(ErrorCodeRateLimited, "Too many messages, ignoring you for %s", c.limiter.escalation.MuteFor)
+
+			case verdictMuted:
+				return errDropped
+
+			case verdictDisconnect:
+				log.Printf("in RateLimiting. Disconnecting client %s for flooding", c.ID)
+				c.Manager.kick(c, websocket.ClosePolicyViolation, "Too many messages")
+				return errDropped
+			}
+
+			return next(c, msg)
+		}
+	}
+}
+
+type RateLimitStats struct {
+	// Throttled counts dropped messages by type
+	Throttled   map[string]int64 `json:"throttled"`
+	Mutes       int64            `json:"mutes"`
+	Disconnects int64            `json:"disconnects"`
+}
+
+type rateLimitCounters struct {
+	lock  sync.Mutex
+	stats RateLimitStats
+}
+
+func (c *rateLimitCounters) record(messageType string, v verdict) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.stats.Throttled == nil {
+		c.stats.Throttled = make(map[string]int64)
+	}
+	c.stats.Throttled[messageType]++
+
+	switch v {
+	case verdictMute:
+		c.stats.Mutes++
+	case verdictDisconnect:
+		c.stats.Disconnects++
+	}
+}
+
+func (c *rateLimitCounters) snapshot() RateLimitStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := RateLimitStats{
+		Throttled:   make(map[string]int64, len(c.stats.Throttled)),
+		Mutes:       c.stats.Mutes,
+		Disconnects: c.stats.Disconnects,
+	}
+	for messageType, n := range c.stats.Throttled {
+		stats.Throttled[messageType] = n
+	}
+
+	return stats
+}
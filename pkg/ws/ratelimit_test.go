@@ -0,0 +1,60 @@
+package ws
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterEscalation(t *testing.T) {
+	start := time.Date(2024, 5, 1, 18, 30, 0, 0, time.UTC)
+	l := newLimiter(RateLimits{AnyMessage: {Rate: 1, Burst: 2}}, Escalation{
+		MuteAfter:       2,
+		MuteFor:         10 * time.Second,
+		DisconnectAfter: 4,
+		Window:          time.Minute,
+	})
+
+	for i, step := range []struct {
+		after    time.Duration
+		expected verdict
+	}{
+		{0, verdictAllow},
+		{0, verdictAllow},
+		{0, verdictThrottle},
+		{0, verdictMute},
+		// the bucket has refilled, but the client is still muted
+		{5 * time.Second, verdictMuted},
+		{6 * time.Second, verdictDisconnect},
+	} {
+		if v := l.check("chat", start.Add(step.after)); v != step.expected {
+			t.Fatalf("Expected verdict %d for message %d, got %d", step.expected, i+1, v)
+		}
+	}
+}
+
+func TestLimiterForgetsViolations(t *testing.T) {
+	start := time.Date(2024, 5, 1, 18, 30, 0, 0, time.UTC)
+	l := newLimiter(RateLimits{"list_add": {Rate: 1, Burst: 1}}, Escalation{
+		MuteAfter: 2,
+		MuteFor:   10 * time.Second,
+		Window:    time.Minute,
+	})
+
+	l.check("list_add", start)
+	if v := l.check("list_add", start); v != verdictThrottle {
+		t.Fatalf("Expected throttle, got %d", v)
+	}
+	// other messages have no limit of their own
+	if v := l.check("chat", start); v != verdictAllow {
+		t.Fatalf("Expected other messages to be allowed, got %d", v)
+	}
+
+	later := start.Add(2 * time.Minute)
+	l.check("list_add", later)
+	if v := l.check("list_add", later); v != verdictThrottle {
+		t.Fatalf("Expected throttle once violations were forgotten, got %d", v)
+	}
+	if v := l.check("list_add", later); v != verdictMute {
+		t.Fatalf("Expected mute, got %d", v)
+	}
+}
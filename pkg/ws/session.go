@@ -0,0 +1,100 @@
+package ws
+
+import (
+	"slices"
+	"sync"
+)
+
+// replayBufferSize is how many outgoing messages a session keeps for
+// clients resuming after a reconnect.
+const replayBufferSize = 256
+
+// Sequenced is an outgoing message numbered within its session. Seq is 0
+// for messages that aren't replayed, like errors.
+type Sequenced struct {
+	Seq     int
+	Message MessageOutgoing
+}
+
+// session belongs to a player rather than a connection: it's shared by
+// all of the player's connections, and messages sent while the player is
+// disconnected are kept and replayed once they reconnect.
+type session struct {
+	lock   sync.Mutex
+	seq    int
+	buffer []Sequenced
+	// clients are the connections currently attached
+	clients []*Client
+	// presence is the player's presence last handed to the presence
+	// handler, guarded by the manager lock
+	presence Presence
+}
+
+func newSession(c *Client) *session {
+	return &session{clients: []*Client{c}, presence: PresenceFocused}
+}
+
+func (s *session) send(msg MessageOutgoing) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.seq++
+	sequenced := Sequenced{Seq: s.seq, Message: msg}
+
+	s.buffer = append(s.buffer, sequenced)
+	if len(s.buffer) > replayBufferSize {
+		s.buffer = s.buffer[len(s.buffer)-replayBufferSize:]
+	}
+
+	for _, c := range s.clients {
+		c.egress.push(sequenced)
+	}
+}
+
+// sync delivers msg to c only, numbered with the latest sequence number.
+// It's for snapshots of everything sent so far.
+func (s *session) sync(c *Client, msg MessageOutgoing) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c.egress.push(Sequenced{Seq: s.seq, Message: msg})
+}
+
+func (s *session) detach(c *Client) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.clients = slices.DeleteFunc(s.clients, func(current *Client) bool {
+		return current == c
+	})
+}
+
+// attach adds c to the connections and replays everything after lastSeq
+// to it. It reports false if some of those messages are gone already.
+func (s *session) attach(c *Client, lastSeq int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !slices.Contains(s.clients, c) {
+		s.clients = append(s.clients, c)
+	}
+
+	if lastSeq > s.seq {
+		return false
+	}
+	if lastSeq < s.seq && (len(s.buffer) == 0 || s.buffer[0].Seq > lastSeq+1) {
+		return false
+	}
+	// a replay overflowing the queue would lose messages anyway
+	if s.seq-lastSeq > c.egress.size {
+		return false
+	}
+
+	for _, msg := range s.buffer {
+		if msg.Seq > lastSeq {
+			c.egress.push(msg)
+		}
+	}
+
+	return true
+}
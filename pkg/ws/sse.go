@@ -0,0 +1,221 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// SSEEventStream is the first event of a stream, its data is the stream
+	// ID messages are posted to
+	SSEEventStream = "stream"
+	// SSEEventClose ends a stream, its data is {"code":...,"reason":...}
+	// like a websocket close frame
+	SSEEventClose = "close"
+)
+
+var (
+	ErrSSEClosed         = errors.New("SSE stream is closed")
+	ErrSSEStreamNotFound = errors.New("SSE stream doesn't exist")
+	ErrSSEMessageTooBig  = errors.New("Message is too big")
+)
+
+// SSEConn carries a client over Server-Sent Events, for networks that don't
+// let websocket upgrades through. Outgoing frames become events of the
+// stream, incoming messages are posted separately and handed over by
+// SSEStreams.Post. Writes must happen in the handler serving the stream.
+type SSEConn struct {
+	ID string
+
+	w  http.ResponseWriter
+	rc *http.ResponseController
+	// readLimit is set by the client's reader and checked by Post
+	readLimit atomic.Int64
+	incoming  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+
+	lock        sync.Mutex
+	pongHandler func(appData string) error
+}
+
+func (c *SSEConn) ReadMessage() (int, []byte, error) {
+	select {
+	case data := <-c.incoming:
+		return websocket.TextMessage, data, nil
+	case <-c.closed:
+		return 0, nil, ErrSSEClosed
+	}
+}
+
+func (c *SSEConn) WriteMessage(messageType int, data []byte) error {
+	var event bytes.Buffer
+	switch messageType {
+	case websocket.TextMessage:
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			event.WriteString("data: ")
+			event.Write(line)
+			event.WriteByte('\n')
+		}
+
+	case websocket.PingMessage:
+		// comments keep proxies from timing the stream out
+		event.WriteString(": ping\n")
+
+	case websocket.CloseMessage:
+		frame := struct {
+			Code   int    `json:"code"`
+			Reason string `json:"reason"`
+		}{Code: websocket.CloseNoStatusReceived}
+		if len(data) >= 2 {
+			frame.Code = int(binary.BigEndian.Uint16(data))
+			frame.Reason = string(data[2:])
+		}
+		raw, _ := json.Marshal(frame)
+		fmt.Fprintf(&event, "event: %s\ndata: %s\n", SSEEventClose, raw)
+
+	default:
+		return fmt.Errorf("SSE can't carry websocket message type %d", messageType)
+	}
+	event.WriteByte('\n')
+
+	if _, err := c.w.Write(event.Bytes()); err != nil {
+		return err
+	}
+	if err := c.rc.Flush(); err != nil {
+		return err
+	}
+
+	if messageType == websocket.PingMessage {
+		// the client can't answer, a ping that got through is as good
+		c.lock.Lock()
+		h := c.pongHandler
+		c.lock.Unlock()
+		if h != nil {
+			return h("")
+		}
+	}
+
+	return nil
+}
+
+func (c *SSEConn) SetReadLimit(limit int64) {
+	c.readLimit.Store(limit)
+}
+
+// SetReadDeadline does nothing, the stream is alive as long as its request
+func (c *SSEConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *SSEConn) SetWriteDeadline(t time.Time) error {
+	// not every ResponseWriter supports deadlines, writes just block then
+	c.rc.SetWriteDeadline(t)
+	return nil
+}
+
+// SetPongHandler sets what's called after every ping written, SSE has no
+// pongs
+func (c *SSEConn) SetPongHandler(h func(appData string) error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.pongHandler = h
+}
+
+func (c *SSEConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.onClose()
+	})
+
+	return nil
+}
+
+// SSEStreams keeps open streams so posted messages find their client
+type SSEStreams struct {
+	lock    *sync.RWMutex
+	streams map[string]*SSEConn
+}
+
+func NewSSEStreams() *SSEStreams {
+	return &SSEStreams{
+		lock:    &sync.RWMutex{},
+		streams: make(map[string]*SSEConn),
+	}
+}
+
+// Open starts the event stream of r. The connection closes when the
+// request is done.
+func (s *SSEStreams) Open(w http.ResponseWriter, r *http.Request) (*SSEConn, error) {
+	c := &SSEConn{
+		ID:       uuid.NewString(),
+		w:        w,
+		rc:       http.NewResponseController(w),
+		incoming: make(chan []byte, 16),
+		closed:   make(chan struct{}),
+	}
+	c.onClose = func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		delete(s.streams, c.ID)
+	}
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	// nginx buffers responses otherwise
+	w.Header().Set("x-accel-buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", SSEEventStream, c.ID)
+	if err := c.rc.Flush(); err != nil {
+		return nil, fmt.Errorf("Streaming isn't supported: %w", err)
+	}
+
+	s.lock.Lock()
+	s.streams[c.ID] = c
+	s.lock.Unlock()
+
+	go func() {
+		select {
+		case <-r.Context().Done():
+			c.Close()
+		case <-c.closed:
+		}
+	}()
+
+	return c, nil
+}
+
+// Post hands a message over to the client reading the stream with id
+func (s *SSEStreams) Post(id string, data []byte) error {
+	s.lock.RLock()
+	c, ok := s.streams[id]
+	s.lock.RUnlock()
+	if !ok {
+		return ErrSSEStreamNotFound
+	}
+
+	if limit := c.readLimit.Load(); limit > 0 && int64(len(data)) > limit {
+		return ErrSSEMessageTooBig
+	}
+
+	select {
+	case c.incoming <- data:
+		return nil
+	case <-c.closed:
+		return ErrSSEClosed
+	}
+}
@@ -0,0 +1,95 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// RegisterTyped handles messages of type event with payloads decoded into T
+// and checked with Validate, handler only gets valid payloads. Messages
+// without a payload decode into the zero T.
+func RegisterTyped[T any](m *ConnectionManager, event string, handler func(*Client, T) error, middleware ...Middleware) {
+	var zero T
+	// misconfigured validate tags panic here rather than on first message
+	Validate(zero)
+
+	m.RegisterEventHandler(event, func(c *Client, msg MessageIncoming) error {
+		var payload T
+		if len(msg.Payload) > 0 && !bytes.Equal(msg.Payload, []byte("null")) {
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				return NewError(ErrorCodeBadMessage, "Malformed payload: %s", err.Error())
+			}
+		}
+
+		if fields := Validate(payload); len(fields) > 0 {
+			err := NewError(ErrorCodeInvalidPayload, "Invalid payload: %s %s", fields[0].Field, fields[0].Message)
+			err.Fields = fields
+
+			return err
+		}
+
+		return handler(c, payload)
+	}, middleware...)
+	m.payloads[event] = reflect.TypeOf(zero)
+}
+
+// MessageTypeInfo describes a message type clients can send
+type MessageTypeInfo struct {
+	Type string `json:"type"`
+	// Payload lists the payload fields of types registered with
+	// RegisterTyped
+	Payload []PayloadField `json:"payload,omitempty"`
+}
+
+type PayloadField struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Validate string `json:"validate,omitempty"`
+}
+
+// MessageTypes lists every registered message type, sorted by type
+func (m *ConnectionManager) MessageTypes() []MessageTypeInfo {
+	infos := make([]MessageTypeInfo, 0, len(m.handlers))
+	for event := range m.handlers {
+		info := MessageTypeInfo{Type: event}
+		if t, ok := m.payloads[event]; ok && t.Kind() == reflect.Struct {
+			info.Payload = describePayload(t, "")
+		}
+		infos = append(infos, info)
+	}
+
+	slices.SortFunc(infos, func(a, b MessageTypeInfo) int {
+		return strings.Compare(a.Type, b.Type)
+	})
+
+	return infos
+}
+
+func describePayload(t reflect.Type, prefix string) []PayloadField {
+	var fields []PayloadField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, describePayload(field.Type, prefix)...)
+			continue
+		}
+
+		fields = append(fields, PayloadField{
+			Name:     prefix + fieldName(field),
+			Type:     field.Type.String(),
+			Validate: field.Tag.Get("validate"),
+		})
+		if field.Type.Kind() == reflect.Struct {
+			fields = append(fields, describePayload(field.Type, prefix+fieldName(field)+".")...)
+		}
+	}
+
+	return fields
+}
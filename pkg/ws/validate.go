@@ -0,0 +1,147 @@
+package ws
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrorCodeInvalidPayload is sent for payloads failing validation, the
+// failures are listed in Error.Fields
+const ErrorCodeInvalidPayload = "invalid_payload"
+
+// FieldError is a validation failure of one payload field. Field is the
+// JSON name, nested fields are joined with dots.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Validate checks the `validate` tags of a struct's fields:
+//
+//	required  the field isn't its zero value
+//	min=N     numbers are at least N, strings and slices have at least N
+//	          characters or elements
+//	max=N     the same, at most N
+//
+// Embedded and nested structs are checked as well.
+func Validate(v any) []FieldError {
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	return validateStruct(value, "")
+}
+
+func validateStruct(value reflect.Value, prefix string) []FieldError {
+	var errs []FieldError
+
+	t := value.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		fieldValue := value.Field(i)
+		name := prefix + fieldName(field)
+		if field.Anonymous {
+			// embedded fields are encoded in the parent object
+			name = strings.TrimSuffix(prefix, ".")
+		}
+
+		for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+			if rule == "" {
+				continue
+			}
+			if err := checkRule(fieldValue, rule); err != "" {
+				errs = append(errs, FieldError{Field: name, Rule: rule, Message: err})
+			}
+		}
+
+		nested := fieldValue
+		if nested.Kind() == reflect.Pointer && !nested.IsNil() {
+			nested = nested.Elem()
+		}
+		if nested.Kind() == reflect.Struct {
+			nestedPrefix := name + "."
+			if field.Anonymous {
+				nestedPrefix = prefix
+			}
+			errs = append(errs, validateStruct(nested, nestedPrefix)...)
+		}
+	}
+
+	return errs
+}
+
+func fieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+
+	return name
+}
+
+// checkRule returns why value breaks rule, or nothing if it doesn't
+func checkRule(value reflect.Value, rule string) string {
+	name, arg, _ := strings.Cut(rule, "=")
+	switch name {
+	case "required":
+		if value.IsZero() {
+			return "is required"
+		}
+		return ""
+
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			panic(fmt.Sprintf("ws: invalid validate rule %q", rule))
+		}
+
+		size, unit, ok := measure(value)
+		if !ok {
+			panic(fmt.Sprintf("ws: rule %q doesn't apply to %s", rule, value.Type()))
+		}
+		if name == "min" && size < limit {
+			return fmt.Sprintf("must be at least %s%s", arg, unit)
+		}
+		if name == "max" && size > limit {
+			return fmt.Sprintf("must be at most %s%s", arg, unit)
+		}
+		return ""
+
+	default:
+		panic(fmt.Sprintf("ws: unknown validate rule %q", rule))
+	}
+}
+
+// measure returns what min and max compare: the value of numbers and the
+// length of anything else
+func measure(value reflect.Value) (float64, string, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), "", true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), "", true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), "", true
+	case reflect.String:
+		return float64(utf8.RuneCountInString(value.String())), " characters", true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(value.Len()), " elements", true
+	default:
+		return 0, "", false
+	}
+}
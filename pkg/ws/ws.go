@@ -1,11 +1,15 @@
 package ws
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"reflect"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -24,60 +28,189 @@ const (
 type MessageOutgoing interface{}
 
 type MessageIncoming struct {
+	// ID is optional, messages with an ID are answered with an Ack or
+	// an Error referencing it
+	ID      string          `json:"id,omitempty"`
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload"`
 }
 
+const (
+	MessageTypeAck   = "ack"
+	MessageTypeError = "error"
+	// MessageTypeMalformed stands in for the type of frames that couldn't
+	// be decoded, in middleware and rate limits
+	MessageTypeMalformed = "malformed"
+)
+
+// Ack confirms that the message with ID was handled
+type Ack struct {
+	Type        string `json:"type"`
+	ID          string `json:"id"`
+	MessageType string `json:"message_type"`
+}
+
+// Codes of errors any handler can run into. Applications define their own
+// codes next to these.
+const (
+	ErrorCodeInternal       = "internal"
+	ErrorCodeBadMessage     = "bad_message"
+	ErrorCodeUnknownMessage = "unknown_message"
+	ErrorCodeTimeout        = "timeout"
+)
+
+// Error is what clients get for a failed message. Code is stable and meant
+// for machines, Message is meant for people.
+type Error struct {
+	Type string `json:"type"`
+	// ID and MessageType refer to the message that failed
+	ID          string `json:"id,omitempty"`
+	MessageType string `json:"message_type,omitempty"`
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	// Fields lists what's wrong with an ErrorCodeInvalidPayload payload
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+func NewError(code string, format string, args ...any) Error {
+	return Error{
+		Type:    MessageTypeError,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e Error) Error() string {
+	return e.Message
+}
+
+// asError keeps handler errors, anything else is logged and only sent as
+// an internal error, its details aren't meant for clients
+func asError(err error) Error {
+	var wsErr Error
+	if errors.As(err, &wsErr) {
+		return wsErr
+	}
+
+	log.Printf("in asError. Unexpected error: %s", err.Error())
+	return NewError(ErrorCodeInternal, "Something went wrong")
+}
+
+// Serializer turns outgoing messages into websocket frames. seq is 0 for
+// messages without a sequence number.
 type Serializer interface {
-	Serialize(MessageOutgoing) (int, [][]byte)
+	Serialize(seq int, msg MessageOutgoing) (int, [][]byte)
+}
+
+// Decoder reads incoming frames. Serializers implementing it decode the
+// messages of their clients, JSON is used otherwise.
+type Decoder interface {
+	Decode(data []byte) (MessageIncoming, error)
+}
+
+type jsonDecoder struct{}
+
+func (jsonDecoder) Decode(data []byte) (MessageIncoming, error) {
+	var msg MessageIncoming
+	err := json.Unmarshal(data, &msg)
+
+	return msg, err
 }
 
 type Client struct {
 	ID     string
 	RoomID string
-
-	conn   *websocket.Conn
-	egress chan MessageOutgoing
+	// AuthorizedRoomID is the only room the connection was opened for,
+	// empty if it may join any. Joining is up to the application.
+	AuthorizedRoomID string
+
+	conn    Conn
+	egress  *queue
+	session *session
+	limiter *limiter
+	// closed, closeMessage, leaveTimer, presence and responsive are
+	// guarded by the manager lock
+	closed       bool
+	closeMessage []byte
+	leaveTimer   *time.Timer
+	presence     Presence
+	responsive   bool
+	done         chan struct{}
+	// lastPong is when the last pong came in, in unix nanoseconds
+	lastPong atomic.Int64
+	// pending has the result of a handler that timed out but is still
+	// running, only the read loop touches it
+	pending chan error
 
 	Serializer Serializer
+	decoder    Decoder
 	Manager    *ConnectionManager
 }
 
 func NewClient(
-	conn *websocket.Conn,
+	conn Conn,
 	manager *ConnectionManager,
 	serializer Serializer,
 ) *Client {
-	return &Client{
+	c := &Client{
 		ID:         uuid.NewString(),
 		RoomID:     "",
 		conn:       conn,
-		egress:     make(chan MessageOutgoing),
+		egress:     newQueue(manager.options.QueueSize, manager.options.OverflowPolicy),
+		presence:   PresenceFocused,
+		responsive: true,
+		done:       make(chan struct{}),
 		Serializer: serializer,
 		Manager:    manager,
 	}
+	c.session = newSession(c)
+	c.decoder, _ = serializer.(Decoder)
+	if c.decoder == nil {
+		c.decoder = jsonDecoder{}
+	}
+	c.limiter = newLimiter(manager.options.RateLimits, manager.options.Escalation)
+
+	return c
 }
 
 func (c *Client) WriteMessages() {
 	ticker := time.NewTicker(pingPeriod)
+	// pongDue fires pongTimeout after a ping, nil while no ping is out
+	var pongDue <-chan time.Time
+	var pingSent time.Time
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		close(c.done)
 	}()
 
 	for {
 		select {
-		case msg, ok := <-c.egress:
-			if !ok {
-				log.Printf("Client %s has disconnected", c.ID)
-				c.conn.WriteMessage(websocket.CloseMessage, nil)
+		case <-c.egress.ready:
+			queued, closed, evicted := c.egress.pop()
+			if evicted {
+				log.Printf("Client %s is too slow, evicting", c.ID)
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				c.conn.WriteMessage(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Client is too slow"),
+				)
 				return
 			}
 
-			messageType, messages := c.Serializer.Serialize(msg)
-			for i := range messages {
+			for _, msg := range queued {
+				messageType, messages := c.Serializer.Serialize(msg.Seq, msg.Message)
+				for i := range messages {
+					c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+					c.conn.WriteMessage(messageType, messages[i])
+				}
+			}
+
+			if closed {
+				log.Printf("Client %s has disconnected", c.ID)
 				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-				c.conn.WriteMessage(messageType, messages[i])
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage)
+				return
 			}
 
 		case t := <-ticker.C:
@@ -87,6 +220,14 @@ func (c *Client) WriteMessages() {
 				log.Printf("in WriteMessages. Failed to write ping message: %s", err.Error())
 				return
 			}
+			pingSent = t
+			pongDue = time.After(pongTimeout)
+
+		case <-pongDue:
+			pongDue = nil
+			if c.lastPong.Load() < pingSent.UnixNano() {
+				c.Manager.setResponsive(c, false)
+			}
 		}
 	}
 }
@@ -96,6 +237,8 @@ func (c *Client) ReadMessages() {
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.lastPong.Store(time.Now().UnixNano())
+		c.Manager.setResponsive(c, true)
 		return nil
 	})
 
@@ -114,55 +257,172 @@ func (c *Client) ReadMessages() {
 			break
 		}
 
-		var msg MessageIncoming
-		if err := json.Unmarshal(raw, &msg); err != nil {
-			c.ReportError(err)
-			continue
+		msg, err := c.decoder.Decode(raw)
+		if err != nil {
+			c.Manager.handleMalformed(c, err)
+		} else {
+			c.Manager.handleMessage(c, msg)
+			c.awaitHandler()
+		}
+		if c.Manager.isClosed(c) {
+			// kicked while handling the message
+			return
 		}
-
-		c.Manager.handleMessage(c, msg)
 	}
 }
 
 func (c *Client) ReportError(err error) {
-	c.egress <- err
+	c.Reply(asError(err))
 }
 
+// Reply is only meant for this connection, like answers to its messages.
+// It isn't numbered or replayed.
+func (c *Client) Reply(msg MessageOutgoing) {
+	c.egress.push(Sequenced{Message: msg})
+}
+
+// Send numbers msg and delivers it to every connection of the player.
+// While the player is disconnected it's only kept for replay.
 func (c *Client) Send(msg MessageOutgoing) {
-	c.egress <- msg
+	c.session.send(msg)
+}
+
+// Sync sends this connection a snapshot of everything sent to the player
+// so far. It isn't replayed, but a resume continues after it.
+func (c *Client) Sync(msg MessageOutgoing) {
+	c.session.sync(c, msg)
 }
 
-type EventHandler func(*Client, MessageIncoming)
+type EventHandler func(*Client, MessageIncoming) error
 
 type ConnectionManager struct {
-	lock    *sync.RWMutex
-	clients map[string]*Client
-	rooms   map[string][]*Client
+	lock *sync.RWMutex
+	// clients has the connections of every player, by player ID
+	clients map[string][]*Client
+	// rooms has every connection in the room, a player's connections
+	// share a session
+	rooms map[string][]*Client
+	// set once the manager is shut down, clients closed from then on
+	// don't leave their rooms
+	closing bool
+	// closeMessage is sent to clients added after shutdown
+	closeMessage []byte
 
 	// Client will be removed from room before onLeave call.
-	// No messages will be delivered to disconnected client.
-	onLeave func(c *Client)
+	// No messages will be delivered to disconnected client. Players of
+	// nodes that went away leave with a stand-in client, only ID, RoomID
+	// and Manager are set.
+	onLeave    func(c *Client)
+	onPresence func(c *Client, presence Presence)
+	// presenceChanges has the latest presence of players whose presence
+	// changed since the presence handler last ran, presenceChanged
+	// wakes it up
+	presenceChanges map[roomPlayer]Presence
+	presenceChanged chan struct{}
+
+	options    Options
+	rateLimits rateLimitCounters
+
+	// node identifies this manager on the backplane
+	node string
+	// remote tracks clients connected to other nodes, by room
+	remote map[string]map[string]string
+	// nodes has when other nodes were last heard from
+	nodes map[string]time.Time
+	// stopped is closed by Shutdown, it stops background work
+	stopped chan struct{}
+
+	handlers   map[string]EventHandler
+	middleware []Middleware
+	// payloads has payload types of handlers registered with RegisterTyped
+	payloads map[string]reflect.Type
+	// timeouts override Options.HandlerTimeout by message type
+	timeouts map[string]time.Duration
+	// handlerSlots has a value for every running isolated handler
+	handlerSlots chan struct{}
+}
+
+type Options struct {
+	// ResumeGrace is how long a disconnected client stays in its room
+	// waiting to be resumed before onLeave is called
+	ResumeGrace time.Duration
+	// QueueSize bounds every client's outbound queue
+	QueueSize      int
+	OverflowPolicy OverflowPolicy
+	// RateLimits apply to incoming messages of every client through the
+	// RateLimiting middleware, nil disables rate limiting
+	RateLimits RateLimits
+	Escalation Escalation
+	// Backplane is optional, without it only clients connected to this
+	// process are reached. Codec must know every broadcast message type.
+	Backplane Backplane
+	Codec     *MessageCodec
+	// HandlerTimeout is how long the sender waits for a handler before
+	// getting an error, 0 waits forever. See SetHandlerTimeout.
+	HandlerTimeout time.Duration
+	// MaxHandlers caps the handlers running at once across all clients,
+	// 0 doesn't cap them. It only applies to handlers with a timeout.
+	MaxHandlers int
+}
 
-	handlers map[string]EventHandler
+var DefaultOptions = Options{
+	ResumeGrace:    30 * time.Second,
+	QueueSize:      64,
+	OverflowPolicy: OverflowCoalesce,
+	HandlerTimeout: 10 * time.Second,
+	MaxHandlers:    1024,
+	Escalation: Escalation{
+		MuteAfter:       5,
+		MuteFor:         10 * time.Second,
+		DisconnectAfter: 20,
+		Window:          30 * time.Second,
+	},
 }
 
-func NewConnectionManager(onLeave func(c *Client)) *ConnectionManager {
-	return &ConnectionManager{
+func NewConnectionManager(onLeave func(c *Client), options Options) *ConnectionManager {
+	m := &ConnectionManager{
 		lock:    &sync.RWMutex{},
-		clients: make(map[string]*Client, baseClientsCount),
+		clients: make(map[string][]*Client, baseClientsCount),
 		rooms:   make(map[string][]*Client, baseRoomsCount),
 		onLeave: onLeave,
+		options: options,
+		node:    uuid.NewString(),
+		remote:  make(map[string]map[string]string),
+		nodes:   make(map[string]time.Time),
+		stopped: make(chan struct{}),
+
+		presenceChanges: make(map[roomPlayer]Presence),
+		presenceChanged: make(chan struct{}, 1),
 
 		handlers: make(map[string]EventHandler),
+		payloads: make(map[string]reflect.Type),
+		timeouts: make(map[string]time.Duration),
+	}
+	if options.MaxHandlers > 0 {
+		m.handlerSlots = make(chan struct{}, options.MaxHandlers)
 	}
+	if options.Backplane != nil {
+		options.Backplane.Subscribe(m.receive)
+		go m.heartbeat()
+	}
+
+	return m
 }
 
 func (m *ConnectionManager) AddClient(c *Client) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	m.clients[c.ID] = c
 	c.Manager = m
+	if m.closing {
+		// the listener may still accept a connection or two while
+		// shutting down, they're turned away right away
+		c.closed = true
+		c.closeMessage = m.closeMessage
+		c.egress.close()
+		return
+	}
+	m.clients[c.ID] = append(m.clients[c.ID], c)
 }
 
 func (m *ConnectionManager) AssignRoom(c *Client, roomID string) error {
@@ -175,77 +435,365 @@ func (m *ConnectionManager) AssignRoom(c *Client, roomID string) error {
 
 	m.rooms[roomID] = append(m.rooms[roomID], c)
 	c.RoomID = roomID
+	m.publishPresence(roomID, c.ID, true)
 
 	return nil
 }
 
+// DeleteRoom closes the room's clients on every node
 func (m *ConnectionManager) DeleteRoom(roomID string) {
+	m.deleteRoom(roomID)
+	m.publish(Envelope{Kind: EnvelopeDeleteRoom, RoomID: roomID}, nil)
+}
+
+func (m *ConnectionManager) deleteRoom(roomID string) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
+	delete(m.remote, roomID)
 	roomToDelete, ok := m.rooms[roomID]
 	if !ok {
 		return
 	}
 
-	for _, c := range roomToDelete {
-		m.RemoveClient(c)
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Room closed")
+	// removeClient edits the room in place
+	for _, c := range slices.Clone(roomToDelete) {
+		if c.leaveTimer != nil {
+			c.leaveTimer.Stop()
+		}
+		c.closeMessage = closeMessage
+		m.removeClient(c)
 	}
 
 	delete(m.rooms, roomID)
 }
 
+// RemoveClient closes the connection. The player's last connection in a
+// room stays there for the resume grace period, so a quick reconnect
+// doesn't count as leaving.
 func (m *ConnectionManager) RemoveClient(c *Client) {
 	m.lock.Lock()
+	if !c.closed && !m.closing && m.options.ResumeGrace > 0 &&
+		slices.Contains(m.rooms[c.RoomID], c) && !m.hasOtherConnections(c) {
+		m.disconnect(c)
+		c.leaveTimer = time.AfterFunc(m.options.ResumeGrace, func() {
+			m.expire(c)
+		})
+		m.lock.Unlock()
 
-	delete(m.clients, c.ID)
-	close(c.egress)
+		m.updatePresence(c)
+		return
+	}
 
-	room, ok := m.rooms[c.RoomID]
-	if ok {
-		m.rooms[c.RoomID] = slices.DeleteFunc(room, func(current *Client) bool {
-			if current == c {
-				return true
-			}
+	left := m.removeClient(c) && !m.closing && !m.hasOtherConnections(c)
+	m.lock.Unlock()
+
+	m.leave(c, left)
+	m.updatePresence(c)
+}
+
+// kick removes c right away, without a resume grace period
+func (m *ConnectionManager) kick(c *Client, code int, reason string) {
+	m.lock.Lock()
+	if !c.closed {
+		c.closeMessage = websocket.FormatCloseMessage(code, reason)
+	}
+	left := m.removeClient(c) && !m.closing && !m.hasOtherConnections(c)
+	m.lock.Unlock()
+
+	m.leave(c, left)
+	m.updatePresence(c)
+}
+
+func (m *ConnectionManager) isClosed(c *Client) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return c.closed
+}
+
+// hasOtherConnections must be called with the lock held. It reports
+// whether c's player has another connection in the room, connected or
+// waiting to be resumed.
+func (m *ConnectionManager) hasOtherConnections(c *Client) bool {
+	return slices.ContainsFunc(m.rooms[c.RoomID], func(current *Client) bool {
+		return current.ID == c.ID && current != c
+	})
+}
+
+// leave tells other nodes the player of c is gone and calls onLeave,
+// unless the player is still connected through another node
+func (m *ConnectionManager) leave(c *Client, left bool) {
+	if !left {
+		return
+	}
+
+	m.publishPresence(c.RoomID, c.ID, false)
+	if m.presentElsewhere(c.RoomID, c.ID) {
+		return
+	}
+	m.onLeave(c)
+}
+
+func (m *ConnectionManager) RateLimitStats() RateLimitStats {
+	return m.rateLimits.snapshot()
+}
+
+// Resume adds c to the connections its player already has in the room
+// and replays messages sent after lastSeq. It reports whether the player
+// was in the room, and whether the replay was complete. Connections
+// waiting to be resumed are replaced by c, open ones are kept.
+func (m *ConnectionManager) Resume(c *Client, roomID string, lastSeq int) (resumed bool, replayed bool) {
+	m.lock.Lock()
+	var s *session
+	room := slices.DeleteFunc(m.rooms[roomID], func(current *Client) bool {
+		if current.ID != c.ID || current == c {
 			return false
-		})
+		}
+		s = current.session
+		if !current.closed {
+			return false
+		}
+		if current.leaveTimer != nil {
+			current.leaveTimer.Stop()
+		}
 
+		return true
+	})
+	if s == nil {
 		m.lock.Unlock()
-		m.onLeave(c)
+		return false, false
+	}
+
+	if !slices.Contains(room, c) {
+		room = append(room, c)
+	}
+	m.rooms[roomID] = room
+	c.session = s
+	c.RoomID = roomID
+	m.lock.Unlock()
+
+	m.publishPresence(roomID, c.ID, true)
+	replayed = s.attach(c, lastSeq)
+	m.updatePresence(c)
+
+	return true, replayed
+}
+
+// expire removes a client that wasn't resumed in time
+func (m *ConnectionManager) expire(c *Client) {
+	m.lock.Lock()
+	wasInRoom := slices.Contains(m.rooms[c.RoomID], c)
+	if wasInRoom {
+		m.rooms[c.RoomID] = slices.DeleteFunc(m.rooms[c.RoomID], func(current *Client) bool {
+			return current == c
+		})
+	}
+	left := wasInRoom && !m.closing && !m.hasOtherConnections(c)
+	m.lock.Unlock()
+
+	m.leave(c, left)
+}
+
+// disconnect must be called with the lock held. It closes the connection
+// but keeps the client in its room.
+func (m *ConnectionManager) disconnect(c *Client) {
+	c.closed = true
+
+	connections := slices.DeleteFunc(m.clients[c.ID], func(current *Client) bool {
+		return current == c
+	})
+	if len(connections) == 0 {
+		delete(m.clients, c.ID)
 	} else {
-		m.lock.Unlock()
+		m.clients[c.ID] = connections
+	}
+	c.session.detach(c)
+	c.egress.close()
+}
+
+// removeClient must be called with the lock held. It reports whether the
+// client was in a room.
+func (m *ConnectionManager) removeClient(c *Client) bool {
+	if c.closed {
+		return false
+	}
+	m.disconnect(c)
+
+	room, ok := m.rooms[c.RoomID]
+	if !ok {
+		return false
 	}
+
+	m.rooms[c.RoomID] = slices.DeleteFunc(room, func(current *Client) bool {
+		return current == c
+	})
+
+	return true
 }
 
-func (m *ConnectionManager) RegisterEventHandler(event string, handler EventHandler) {
-	m.handlers[event] = handler
+// ReconnectHint is a close reason telling clients when to reconnect, it
+// ends with "reconnect_in=<milliseconds>"
+func ReconnectHint(after time.Duration) string {
+	return fmt.Sprintf("Server is going away, reconnect_in=%d", after.Milliseconds())
+}
+
+// Shutdown closes every client with the given close code and reason and
+// waits until close frames are written or ctx is done. Rooms are kept
+// intact: onLeave isn't called for clients closed by Shutdown. Other nodes
+// are told the players are gone, the leader calls onLeave for those who
+// don't come back.
+func (m *ConnectionManager) Shutdown(ctx context.Context, code int, reason string) {
+	m.lock.Lock()
+	if !m.closing {
+		close(m.stopped)
+	}
+	m.closing = true
+	m.closeMessage = websocket.FormatCloseMessage(code, reason)
+
+	// collected first, removing the clients takes them out of their rooms
+	players := make(map[roomPlayer]bool)
+	for roomID, room := range m.rooms {
+		for _, c := range room {
+			players[roomPlayer{roomID: roomID, clientID: c.ID}] = true
+		}
+	}
+
+	clients := make([]*Client, 0, len(m.clients))
+	for _, connections := range m.clients {
+		clients = append(clients, connections...)
+	}
+	for _, c := range clients {
+		c.closeMessage = m.closeMessage
+		m.removeClient(c)
+	}
+	m.lock.Unlock()
+
+	for player := range players {
+		m.publish(Envelope{
+			Kind:     EnvelopePresence,
+			RoomID:   player.roomID,
+			ClientID: player.clientID,
+			NodeGone: true,
+		}, nil)
+	}
+
+	for _, c := range clients {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RegisterEventHandler handles messages of type event with handler wrapped
+// in middleware, inside of the middleware added with Use
+func (m *ConnectionManager) RegisterEventHandler(event string, handler EventHandler, middleware ...Middleware) {
+	m.handlers[event] = Chain(handler, middleware...)
+	delete(m.payloads, event)
+}
+
+// Use adds middleware run for every message, unknown types included.
+// Middleware added first runs first.
+func (m *ConnectionManager) Use(middleware ...Middleware) {
+	m.middleware = append(m.middleware, middleware...)
 }
 
 func (m *ConnectionManager) handleMessage(client *Client, message MessageIncoming) {
 	handler, ok := m.handlers[message.Type]
 	if !ok {
-		log.Printf("in handleMessage. Unhandled message type %q", message.Type)
+		handler = unknownMessage
+	}
+
+	m.dispatch(client, message, handler)
+}
+
+// handleMalformed answers a frame that couldn't be decoded. It still goes
+// through the global middleware, so malformed frames are rate limited like
+// any other message.
+func (m *ConnectionManager) handleMalformed(client *Client, decodeErr error) {
+	message := MessageIncoming{Type: MessageTypeMalformed}
+	m.dispatch(client, message, func(*Client, MessageIncoming) error {
+		return NewError(ErrorCodeBadMessage, "Malformed message: %s", decodeErr.Error())
+	})
+}
+
+func (m *ConnectionManager) dispatch(client *Client, message MessageIncoming, handler EventHandler) {
+	// global middleware runs on the read loop, the handler itself is
+	// isolated so a panic or a stuck handler only fails this message. The
+	// read loop still waits for a stuck handler before the next message.
+	err := safeCall(Chain(m.isolate(message.Type, handler), m.middleware...), client, message)
+	if errors.Is(err, errDropped) {
+		return
+	}
+	if err != nil {
+		wsErr := asError(err)
+		wsErr.ID = message.ID
+		wsErr.MessageType = message.Type
+		client.ReportError(wsErr)
 		return
 	}
 
-	handler(client, message)
+	if message.ID == "" {
+		return
+	}
+	client.Reply(Ack{
+		Type:        MessageTypeAck,
+		ID:          message.ID,
+		MessageType: message.Type,
+	})
 }
 
+// Broadcast sends message to every client in the room, on every node
 func (m *ConnectionManager) Broadcast(roomID string, message MessageOutgoing) {
+	m.deliver(roomID, "", "", message)
+	m.publish(Envelope{Kind: EnvelopeBroadcast, RoomID: roomID}, message)
+}
+
+// BroadcastExcept sends message to everyone in the room but clientID
+func (m *ConnectionManager) BroadcastExcept(roomID string, clientID string, message MessageOutgoing) {
+	m.deliver(roomID, "", clientID, message)
+	m.publish(Envelope{Kind: EnvelopeBroadcast, RoomID: roomID, ClientID: clientID}, message)
+}
+
+// SendTo sends message to clientID in the room, whichever node it's on
+func (m *ConnectionManager) SendTo(roomID string, clientID string, message MessageOutgoing) {
+	m.deliver(roomID, clientID, "", message)
+	m.publish(Envelope{Kind: EnvelopeSendTo, RoomID: roomID, ClientID: clientID}, message)
+}
+
+// deliver sends message to local players of the room, only to the player
+// with ID only if it's set, and never to the one with ID except. Every
+// player gets it once, their session passes it on to each connection.
+func (m *ConnectionManager) deliver(roomID string, only string, except string, message MessageOutgoing) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
 	room, ok := m.rooms[roomID]
 	if !ok {
-		log.Println("in Broadcast. Broadcast to non-existent room")
+		if m.options.Backplane == nil {
+			log.Println("in Broadcast. Broadcast to non-existent room")
+		}
 		return
 	}
 
+	sent := make([]*session, 0, len(room))
 	for i := range room {
+		if (only != "" && room[i].ID != only) || (except != "" && room[i].ID == except) {
+			continue
+		}
+		if slices.Contains(sent, room[i].session) {
+			continue
+		}
+		sent = append(sent, room[i].session)
 		room[i].Send(message)
 	}
 }
 
+// BroadcastFunc only reaches clients of this node, use Broadcast, SendTo or
+// BroadcastExcept for anything other nodes need to see
 func (m *ConnectionManager) BroadcastFunc(roomID string, sendFunc func(c *Client)) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
@@ -176,7 +176,10 @@ class Search extends HTMLElement {
 <li 
     ws-send 
     hx-trigger="click" 
-    hx-vals='js:...(event.target.hasAttribute("data-selected") ? ${escape(valsRemove)}: ${escape(valsAdd)})' 
+    hx-vals='js:{
+        ...(event.target.hasAttribute("data-selected") ? ${escape(valsRemove)}: ${escape(valsAdd)}),
+        "id": trackSelection(event.target.closest("li"))
+    }' 
     class="flex gap-2 cursor-pointer data-[active='true']:outline data-[selected='true']:bg-green-100"
 >
     <img
@@ -250,6 +253,37 @@ class Search extends HTMLElement {
     }
 }
 
+/**
+ * Selection is toggled right away, messages that fail toggle it back.
+ * @type {Map<string, HTMLElement>}
+ */
+const pendingSelections = new Map();
+let lastMessageID = 0;
+
+/** @param {HTMLElement} option */
+function trackSelection(option) {
+    const id = `search-${++lastMessageID}`;
+    pendingSelections.set(id, option);
+    return id;
+}
+
+document.addEventListener("htmx:wsAfterMessage", (e) => {
+    if (!e.detail.message.includes('id="reply"')) {
+        return;
+    }
+
+    const reply = document.getElementById("reply");
+    const option = pendingSelections.get(reply.dataset.id);
+    if (!option) {
+        return;
+    }
+    pendingSelections.delete(reply.dataset.id);
+
+    if (reply.dataset.status === "error") {
+        option.toggleAttribute("data-selected");
+    }
+});
+
 function debounce(fn, timeout) {
     let timeoutID;
     return function (...args) {
@@ -0,0 +1,115 @@
+/**
+ * WebSocket lookalike over Server-Sent Events, for networks that block
+ * websocket upgrades. Events come from GET /sse, messages are posted to
+ * /sse/{stream} in order.
+ */
+class SSESocket extends EventTarget {
+    static CONNECTING = 0;
+    static OPEN = 1;
+    static CLOSING = 2;
+    static CLOSED = 3;
+
+    CONNECTING = SSESocket.CONNECTING;
+    OPEN = SSESocket.OPEN;
+    CLOSING = SSESocket.CLOSING;
+    CLOSED = SSESocket.CLOSED;
+
+    readyState = SSESocket.CONNECTING;
+    binaryType = "blob";
+    onopen = null;
+    onmessage = null;
+    onclose = null;
+    onerror = null;
+
+    /** @type {EventSource} */
+    source;
+    /** @type {string} */
+    stream;
+    /** @type {Promise<void>} */
+    sending = Promise.resolve();
+
+    /**
+     * @param {string | URL} url websocket URL, /ws is swapped for /sse
+     * @param {string} protocol
+     */
+    constructor(url, protocol) {
+        super();
+
+        const sseURL = new URL(url, location.href);
+        sseURL.protocol = location.protocol;
+        sseURL.pathname = "/sse";
+        sseURL.searchParams.set("protocol", protocol);
+        this.protocol = protocol;
+
+        this.source = new EventSource(sseURL);
+        this.source.addEventListener("stream", (event) => {
+            this.stream = event.data;
+            this.readyState = SSESocket.OPEN;
+            this.emit(new Event("open"));
+        });
+        this.source.addEventListener("message", (event) => {
+            this.emit(new MessageEvent("message", { data: event.data }));
+        });
+        this.source.addEventListener("close", (event) => {
+            const { code, reason } = JSON.parse(event.data);
+            this.finish(code, reason);
+        });
+        // EventSource reconnects on its own, but a new stream is a new
+        // connection, so it's left to whoever opened this socket
+        this.source.addEventListener("error", () => {
+            if (this.readyState === SSESocket.CLOSED) {
+                return;
+            }
+            this.emit(new Event("error"));
+            this.finish(1006, "");
+        });
+    }
+
+    /** @param {string} data */
+    send(data) {
+        if (this.readyState !== SSESocket.OPEN) {
+            throw new DOMException("SSESocket is not open", "InvalidStateError");
+        }
+
+        this.sending = this.sending
+            .then(() =>
+                fetch(`/sse/${this.stream}`, {
+                    method: "POST",
+                    headers: { "content-type": "application/json" },
+                    body: data,
+                })
+            )
+            .then((response) => {
+                if (!response.ok) {
+                    this.finish(1006, "");
+                }
+            })
+            .catch(() => this.finish(1006, ""));
+    }
+
+    close(code = 1000, reason = "") {
+        this.finish(code, reason);
+    }
+
+    /**
+     * @param {number} code
+     * @param {string} reason
+     */
+    finish(code, reason) {
+        if (this.readyState === SSESocket.CLOSED) {
+            return;
+        }
+
+        this.readyState = SSESocket.CLOSED;
+        this.source.close();
+        this.emit(
+            new CloseEvent("close", { code, reason, wasClean: code !== 1006 })
+        );
+    }
+
+    /** @param {Event} event */
+    emit(event) {
+        this[`on${event.type}`]?.(event);
+        this.dispatchEvent(event);
+    }
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
+	"maps"
+	"slices"
 	"sync"
 	"time"
 
@@ -12,9 +15,10 @@ import (
 )
 
 type Player struct {
-	ID    string
-	Name  string
-	Ready bool
+	ID       string
+	Name     string
+	Ready    bool
+	Presence ws.Presence
 }
 
 type RoomStage string
@@ -44,45 +48,96 @@ type Candidate struct {
 }
 
 type Room struct {
-	ID                   string
-	HostID               string
-	Stage                RoomStage
-	Time                 time.Duration
-	ScheduledForDeletion bool
-	Players              map[string]Player
-	Lists                map[string][]ListItem
-	Candidates           []Candidate
+	ID           string
+	HostID       string
+	Stage        RoomStage
+	Time         time.Duration
+	Players      map[string]Player
+	Lists        map[string][]ListItem
+	Candidates   []Candidate
+	LastEventSeq int
+	// Version is bumped by every successful update
+	Version int
+
+	CreatedAt      time.Time
+	LastActivityAt time.Time
+	// EmptySince is zero while there are players in the room
+	EmptySince time.Time
+	FinishedAt time.Time
 }
 
 func NewRoom() Room {
+	now := time.Now()
+
 	return Room{
 		ID:     uuid.NewString(),
 		Time:   0,
 		Stage:  StageLobby,
 		HostID: "",
 
+		CreatedAt:      now,
+		LastActivityAt: now,
+		EmptySince:     now,
+
 		Players:    make(map[string]Player),
 		Lists:      make(map[string][]ListItem),
 		Candidates: nil,
 	}
 }
 
+// Clone copies room along with its players, lists and candidates, the copy
+// shares nothing that updates of the original change
+func (room Room) Clone() Room {
+	clone := room
+	clone.Players = maps.Clone(room.Players)
+	if room.Lists != nil {
+		clone.Lists = make(map[string][]ListItem, len(room.Lists))
+		for playerID, list := range room.Lists {
+			clone.Lists[playerID] = slices.Clone(list)
+		}
+	}
+	clone.Candidates = slices.Clone(room.Candidates)
+	for i := range clone.Candidates {
+		clone.Candidates[i].Voters = slices.Clone(room.Candidates[i].Voters)
+	}
+
+	return clone
+}
+
+var (
+	ErrRoomNotFound        = errors.New("Room doesn't exist")
+	ErrRoomVersionConflict = errors.New("Room was changed concurrently")
+)
+
 type RoomsRepository interface {
 	Add(room Room)
 	Find(id string) *Room
 	Update(id string, updateFn func(*Room) error) error
+	// CompareAndUpdate works like Update, but fails with
+	// ErrRoomVersionConflict unless the stored room is at version.
+	CompareAndUpdate(id string, version int, updateFn func(*Room) error) error
 	Delete(id string)
+	IDs() []string
 }
 
+// InMemoryRoomsRepository locks rooms individually, so a slow update in one
+// room never holds back the others. The repository lock only guards the
+// rooms map itself.
 type InMemoryRoomsRepository struct {
 	lock  *sync.RWMutex
-	rooms map[string]Room
+	rooms map[string]*roomEntry
+}
+
+type roomEntry struct {
+	lock    sync.Mutex
+	room    Room
+	deleted bool
 }
 
 func NewInMemoryRoomsRepository() *InMemoryRoomsRepository {
 	return &InMemoryRoomsRepository{
 		lock:  &sync.RWMutex{},
-		rooms: make(map[string]Room),
+		rooms: make(map[string]*roomEntry),
 	}
 }
 
@@ -90,86 +145,213 @@ func (r *InMemoryRoomsRepository) Add(room Room) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
-	r.rooms[room.ID] = room
+	r.rooms[room.ID] = &roomEntry{room: room.Clone()}
 }
 
-func (r *InMemoryRoomsRepository) Find(id string) *Room {
+func (r *InMemoryRoomsRepository) entry(id string) *roomEntry {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
 
-	room, ok := r.rooms[id]
-	if !ok {
+	return r.rooms[id]
+}
+
+func (r *InMemoryRoomsRepository) Find(id string) *Room {
+	entry := r.entry(id)
+	if entry == nil {
 		return nil
 	}
 
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	if entry.deleted {
+		return nil
+	}
+	// callers read the room without the lock, updates mustn't reach it
+	room := entry.room.Clone()
+
 	return &room
 }
 
 func (r *InMemoryRoomsRepository) Update(id string, updateFn func(room *Room) error) error {
-	r.lock.Lock()
-	defer r.lock.Unlock()
+	return r.update(id, -1, updateFn)
+}
 
-	room, ok := r.rooms[id]
-	if !ok {
-		return fmt.Errorf("Room doesn't exist")
+func (r *InMemoryRoomsRepository) CompareAndUpdate(id string, version int, updateFn func(room *Room) error) error {
+	return r.update(id, version, updateFn)
+}
+
+// update checks the room version unless version is negative
+func (r *InMemoryRoomsRepository) update(id string, version int, updateFn func(room *Room) error) error {
+	entry := r.entry(id)
+	if entry == nil {
+		return ErrRoomNotFound
+	}
+
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	if entry.deleted {
+		return ErrRoomNotFound
 	}
 
+	// a failed update leaves the stored room as it was
+	room := entry.room.Clone()
+	if version >= 0 && room.Version != version {
+		return ErrRoomVersionConflict
+	}
+	room.Version++
+
 	err := updateFn(&room)
 	if err != nil {
 		return err
 	}
 
-	r.rooms[room.ID] = room
+	entry.room = room
 
 	return nil
 }
 
 func (r *InMemoryRoomsRepository) Delete(id string) {
 	r.lock.Lock()
-	defer r.lock.Unlock()
-
+	entry, ok := r.rooms[id]
 	delete(r.rooms, id)
+	r.lock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	// an update in progress finishes first, later ones see the room gone
+	entry.lock.Lock()
+	entry.deleted = true
+	entry.lock.Unlock()
+}
+
+func (r *InMemoryRoomsRepository) IDs() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	ids := make([]string, 0, len(r.rooms))
+	for id := range r.rooms {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func (r *InMemoryRoomsRepository) Rooms() []Room {
+	r.lock.RLock()
+	entries := make([]*roomEntry, 0, len(r.rooms))
+	for _, entry := range r.rooms {
+		entries = append(entries, entry)
+	}
+	r.lock.RUnlock()
+
+	rooms := make([]Room, 0, len(entries))
+	for _, entry := range entries {
+		entry.lock.Lock()
+		if !entry.deleted {
+			rooms = append(rooms, entry.room.Clone())
+		}
+		entry.lock.Unlock()
+	}
+
+	return rooms
 }
 
-func (r *InMemoryRoomsRepository) RunRoomCleanup(manager *ws.ConnectionManager) {
-	ticker := time.NewTicker(5 * time.Minute)
+// RunRoomCleanup deletes expired rooms until ctx is done
+func RunRoomCleanup(ctx context.Context, rooms RoomsRepository, manager *ws.ConnectionManager, policy ExpiryPolicy) {
+	if policy.CheckInterval <= 0 {
+		log.Println("Room cleanup is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(policy.CheckInterval)
+	defer ticker.Stop()
 	deleteCount := 0
 
 	for {
-		<-ticker.C
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Other nodes share the rooms, only the leader expires them
+		if !manager.Leader() {
+			continue
+		}
 		log.Println("Running cleanup")
 
-		r.lock.Lock()
-		for id, room := range r.rooms {
-			if room.ScheduledForDeletion {
-				deleteCount++
-				manager.DeleteRoom(id)
-				delete(r.rooms, id)
+		now := time.Now()
+		for _, id := range rooms.IDs() {
+			if ctx.Err() != nil {
+				return
+			}
+
+			room := rooms.Find(id)
+			if room == nil {
+				continue
+			}
+
+			reason, expired := policy.Expired(*room, now)
+			if !expired {
+				continue
+			}
+
+			// Any activity since Find means the room is in use again
+			err := rooms.CompareAndUpdate(id, room.Version, func(room *Room) error {
+				manager.Broadcast(room.ID, NewEventRoomClosed(*room, reason))
+				manager.DeleteRoom(room.ID)
+
+				return nil
+			})
+			if err != nil {
+				continue
 			}
+
+			rooms.Delete(id)
+			deleteCount++
 		}
-		r.lock.Unlock()
 
 		log.Printf("Rooms deleted: %d", deleteCount)
 		deleteCount = 0
 	}
 }
 
-func (r *InMemoryRoomsRepository) RunRoomTimer(manager *ws.ConnectionManager) {
+// RunRoomTimer counts room timers down until ctx is done
+func RunRoomTimer(ctx context.Context, rooms RoomsRepository, manager *ws.ConnectionManager) {
 	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
 
 	for {
-		<-ticker.C
-		r.lock.Lock()
-		for id, room := range r.rooms {
-			if room.Time <= 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !manager.Leader() {
+			continue
+		}
+		for _, id := range rooms.IDs() {
+			if ctx.Err() != nil {
+				return
+			}
+			if room := rooms.Find(id); room == nil || room.Time <= 0 {
 				continue
 			}
 
-			room.Time = room.Time - 1*time.Second
-			r.rooms[id] = room
+			rooms.Update(id, func(room *Room) error {
+				if room.Time <= 0 {
+					return nil
+				}
+
+				room.Time = room.Time - 1*time.Second
+				manager.Broadcast(room.ID, NewEventRoomTime(*room))
 
-			manager.Broadcast(room.ID, NewEventRoomTime(room))
+				return nil
+			})
 		}
-		r.lock.Unlock()
 	}
 }
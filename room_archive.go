@@ -0,0 +1,233 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+type ArchivedParticipant struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	IsHost bool   `json:"isHost"`
+}
+
+// ArchivedRoom is what's left of a room once it reached the results stage
+type ArchivedRoom struct {
+	ID           string                `json:"id"`
+	CreatedAt    time.Time             `json:"created_at"`
+	FinishedAt   time.Time             `json:"finished_at"`
+	Participants []ArchivedParticipant `json:"participants"`
+	Winners      []resultsEntry        `json:"winners"`
+	// Scores is the full score table, highest score first
+	Scores []resultsEntry `json:"scores"`
+}
+
+func NewArchivedRoom(room Room) ArchivedRoom {
+	winners, others := collectResults(room)
+
+	participants := make([]ArchivedParticipant, 0, len(room.Players))
+	for _, p := range room.Players {
+		participants = append(participants, ArchivedParticipant{
+			ID:     p.ID,
+			Name:   p.Name,
+			IsHost: p.ID == room.HostID,
+		})
+	}
+	slices.SortFunc(participants, func(a, b ArchivedParticipant) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return ArchivedRoom{
+		ID:           room.ID,
+		CreatedAt:    room.CreatedAt,
+		FinishedAt:   room.FinishedAt,
+		Participants: participants,
+		Winners:      winners,
+		Scores:       append(slices.Clone(winners), others...),
+	}
+}
+
+func (a ArchivedRoom) Participated(playerID string) bool {
+	return slices.ContainsFunc(a.Participants, func(p ArchivedParticipant) bool {
+		return p.ID == playerID
+	})
+}
+
+type RoomArchive interface {
+	Add(room ArchivedRoom)
+	// FindByPlayer returns rooms the player took part in, latest first
+	FindByPlayer(playerID string) []ArchivedRoom
+}
+
+type InMemoryRoomArchive struct {
+	lock  *sync.RWMutex
+	rooms []ArchivedRoom
+}
+
+func NewInMemoryRoomArchive() *InMemoryRoomArchive {
+	return &InMemoryRoomArchive{
+		lock: &sync.RWMutex{},
+	}
+}
+
+func (a *InMemoryRoomArchive) Add(room ArchivedRoom) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.rooms = append(a.rooms, room)
+}
+
+func (a *InMemoryRoomArchive) FindByPlayer(playerID string) []ArchivedRoom {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var found []ArchivedRoom
+	for i := len(a.rooms) - 1; i >= 0; i-- {
+		if a.rooms[i].Participated(playerID) {
+			found = append(found, a.rooms[i])
+		}
+	}
+
+	return found
+}
+
+func (a *InMemoryRoomArchive) All() []ArchivedRoom {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return slices.Clone(a.rooms)
+}
+
+const sqliteRoomArchiveSchema = `
+CREATE TABLE IF NOT EXISTS archived_rooms (
+	id          TEXT PRIMARY KEY,
+	created_at  TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP NOT NULL,
+	winners     BLOB NOT NULL,
+	scores      BLOB NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS archived_participants (
+	room_id   TEXT NOT NULL REFERENCES archived_rooms(id) ON DELETE CASCADE,
+	player_id TEXT NOT NULL,
+	name      TEXT NOT NULL,
+	is_host   INTEGER NOT NULL,
+	PRIMARY KEY (room_id, player_id)
+);
+`
+
+type SQLiteRoomArchive struct {
+	db *sql.DB
+}
+
+func NewSQLiteRoomArchive(db *sql.DB) (*SQLiteRoomArchive, error) {
+	if _, err := db.Exec(sqliteRoomArchiveSchema); err != nil {
+		return nil, err
+	}
+
+	return &SQLiteRoomArchive{db: db}, nil
+}
+
+func (a *SQLiteRoomArchive) Add(room ArchivedRoom) {
+	err := a.add(room)
+	if err != nil {
+		log.Printf("in SQLiteRoomArchive.Add. Failed to archive room %s: %s", room.ID, err.Error())
+	}
+}
+
+func (a *SQLiteRoomArchive) add(room ArchivedRoom) error {
+	winners, err := json.Marshal(room.Winners)
+	if err != nil {
+		return err
+	}
+	scores, err := json.Marshal(room.Scores)
+	if err != nil {
+		return err
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT OR REPLACE INTO archived_rooms (id, created_at, finished_at, winners, scores)
+		VALUES (?, ?, ?, ?, ?)`,
+		room.ID, room.CreatedAt, room.FinishedAt, winners, scores,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range room.Participants {
+		_, err := tx.Exec(
+			`INSERT OR REPLACE INTO archived_participants (room_id, player_id, name, is_host)
+			VALUES (?, ?, ?, ?)`,
+			room.ID, p.ID, p.Name, p.IsHost,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (a *SQLiteRoomArchive) FindByPlayer(playerID string) []ArchivedRoom {
+	var found []ArchivedRoom
+	err := queryEach(a.db, `SELECT r.id, r.created_at, r.finished_at, r.winners, r.scores
+		FROM archived_rooms r
+		JOIN archived_participants p ON p.room_id = r.id
+		WHERE p.player_id = ?
+		ORDER BY r.finished_at DESC`,
+		func(rows *sql.Rows) error {
+			var room ArchivedRoom
+			var winners, scores []byte
+			if err := rows.Scan(&room.ID, &room.CreatedAt, &room.FinishedAt, &winners, &scores); err != nil {
+				return err
+			}
+			if err := json.Unmarshal(winners, &room.Winners); err != nil {
+				return err
+			}
+			if err := json.Unmarshal(scores, &room.Scores); err != nil {
+				return err
+			}
+			found = append(found, room)
+
+			return nil
+		},
+		playerID,
+	)
+	if err != nil {
+		log.Printf("in SQLiteRoomArchive.FindByPlayer. Failed to query rooms: %s", err.Error())
+		return nil
+	}
+
+	for i := range found {
+		err := queryEach(a.db, `SELECT player_id, name, is_host
+			FROM archived_participants WHERE room_id = ? ORDER BY name`,
+			func(rows *sql.Rows) error {
+				var p ArchivedParticipant
+				if err := rows.Scan(&p.ID, &p.Name, &p.IsHost); err != nil {
+					return err
+				}
+				found[i].Participants = append(found[i].Participants, p)
+
+				return nil
+			},
+			found[i].ID,
+		)
+		if err != nil {
+			log.Printf("in SQLiteRoomArchive.FindByPlayer. Failed to query participants: %s", err.Error())
+			return nil
+		}
+	}
+
+	return found
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrRoomsDraining = errors.New("Server is shutting down")
+
+// DrainingRoomsRepository keeps track of running updates, so shutdown can
+// wait for them before the rooms are saved. Once draining starts new
+// updates fail with ErrRoomsDraining.
+type DrainingRoomsRepository struct {
+	rooms RoomsRepository
+
+	lock     *sync.Mutex
+	inFlight int
+	draining bool
+	drained  chan struct{}
+}
+
+func NewDrainingRoomsRepository(rooms RoomsRepository) *DrainingRoomsRepository {
+	return &DrainingRoomsRepository{
+		rooms:   rooms,
+		lock:    &sync.Mutex{},
+		drained: make(chan struct{}),
+	}
+}
+
+// Drain stops new updates and waits for the running ones or until ctx is
+// done
+func (r *DrainingRoomsRepository) Drain(ctx context.Context) error {
+	r.lock.Lock()
+	if !r.draining {
+		r.draining = true
+		if r.inFlight == 0 {
+			close(r.drained)
+		}
+	}
+	r.lock.Unlock()
+
+	select {
+	case <-r.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *DrainingRoomsRepository) begin() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.draining {
+		return ErrRoomsDraining
+	}
+	r.inFlight++
+
+	return nil
+}
+
+func (r *DrainingRoomsRepository) end() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.inFlight--
+	if r.draining && r.inFlight == 0 {
+		close(r.drained)
+	}
+}
+
+func (r *DrainingRoomsRepository) Add(room Room) {
+	r.rooms.Add(room)
+}
+
+func (r *DrainingRoomsRepository) Find(id string) *Room {
+	return r.rooms.Find(id)
+}
+
+func (r *DrainingRoomsRepository) Update(id string, updateFn func(*Room) error) error {
+	return r.UpdateTriggeredBy("", id, updateFn)
+}
+
+func (r *DrainingRoomsRepository) UpdateTriggeredBy(trigger string, id string, updateFn func(*Room) error) error {
+	if err := r.begin(); err != nil {
+		return err
+	}
+	defer r.end()
+
+	return updateTriggeredBy(r.rooms, trigger, id, updateFn)
+}
+
+func (r *DrainingRoomsRepository) CompareAndUpdate(id string, version int, updateFn func(*Room) error) error {
+	if err := r.begin(); err != nil {
+		return err
+	}
+	defer r.end()
+
+	return r.rooms.CompareAndUpdate(id, version, updateFn)
+}
+
+func (r *DrainingRoomsRepository) Delete(id string) {
+	r.rooms.Delete(id)
+}
+
+func (r *DrainingRoomsRepository) IDs() []string {
+	return r.rooms.IDs()
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"stmsh/pkg/ws"
+)
+
+// Room events reuse incoming message types where a message maps onto
+// a single mutation.
+const (
+	RoomEventCreated      = "create"
+	RoomEventJoined       = MessageTypeJoin
+	RoomEventLeft         = "leave"
+	RoomEventReadyToggled = MessageTypeUserToggleReady
+	RoomEventStageChanged = MessageTypeNextStage
+	RoomEventTimerSet     = MessageTypeSetTimer
+	RoomEventListAdded    = MessageTypeListAdd
+	RoomEventListRemoved  = MessageTypeListRemove
+	RoomEventVoted        = MessageTypeVote
+	// presence is reported by clients but also inferred by the server
+	RoomEventPresenceChanged = MessageTypePresence
+)
+
+type RoomEvent struct {
+	RoomID   string          `json:"room_id"`
+	Seq      int             `json:"seq"`
+	Type     string          `json:"type"`
+	PlayerID string          `json:"player_id,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+	At       time.Time       `json:"at"`
+}
+
+type (
+	roomEventJoined struct {
+		Name string `json:"name"`
+	}
+
+	roomEventLeft struct {
+		NextHostID string `json:"next_host_id"`
+	}
+
+	roomEventPresenceChanged struct {
+		Presence ws.Presence `json:"presence"`
+	}
+
+	roomEventStageChanged struct {
+		Stage RoomStage `json:"stage"`
+		// Candidates are collected from a map, so their order is only
+		// reproducible if it's recorded.
+		Candidates []Candidate `json:"candidates,omitempty"`
+	}
+)
+
+func NewRoomEvent(room Room, eventType string, playerID string, payload any) (RoomEvent, error) {
+	event := RoomEvent{
+		RoomID:   room.ID,
+		Seq:      room.LastEventSeq + 1,
+		Type:     eventType,
+		PlayerID: playerID,
+		At:       time.Now(),
+	}
+
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return event, err
+		}
+		event.Payload = raw
+	}
+
+	return event, nil
+}
+
+// Apply is the only place where room state changes in response to
+// players. Handlers validate, then apply; replay applies the same events.
+func (room *Room) Apply(e RoomEvent) error {
+	switch e.Type {
+	case RoomEventCreated:
+		room.CreatedAt = e.At
+		room.EmptySince = e.At
+
+	case RoomEventJoined:
+		var payload roomEventJoined
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return err
+		}
+
+		if len(room.Players) == 0 {
+			room.HostID = e.PlayerID
+		}
+
+		// Players rejoining a restored room keep their state
+		p, ok := room.Players[e.PlayerID]
+		if !ok {
+			p = Player{ID: e.PlayerID}
+		}
+		p.Name = payload.Name
+		p.Presence = ws.PresenceFocused
+		room.Players[e.PlayerID] = p
+		room.EmptySince = time.Time{}
+
+	case RoomEventLeft:
+		var payload roomEventLeft
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return err
+		}
+
+		delete(room.Players, e.PlayerID)
+		if room.HostID == e.PlayerID {
+			room.HostID = payload.NextHostID
+		}
+		if len(room.Players) == 0 {
+			room.EmptySince = e.At
+		}
+
+	case RoomEventReadyToggled:
+		var payload MessageUserToggleReady
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return err
+		}
+
+		p := room.Players[e.PlayerID]
+		p.Ready = payload.Ready
+		room.Players[e.PlayerID] = p
+
+	case RoomEventPresenceChanged:
+		var payload roomEventPresenceChanged
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return err
+		}
+
+		// presence may still be reported for a player who just left
+		if p, ok := room.Players[e.PlayerID]; ok {
+			p.Presence = payload.Presence
+			room.Players[e.PlayerID] = p
+		}
+
+		// an away player mustn't keep an idle room alive
+		room.LastEventSeq = e.Seq
+		return nil
+
+	case RoomEventStageChanged:
+		var payload roomEventStageChanged
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return err
+		}
+
+		room.Stage = payload.Stage
+		switch room.Stage {
+		case StageVoting:
+			for _, p := range room.Players {
+				p.Ready = false
+				room.Players[p.ID] = p
+			}
+			room.Candidates = payload.Candidates
+
+		case StageResults:
+			room.FinishedAt = e.At
+		}
+
+	case RoomEventTimerSet:
+		var payload MessageSetTimer
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return err
+		}
+
+		room.Time = time.Duration(payload.TimeInSeconds) * time.Second
+
+	case RoomEventListAdded:
+		var payload listItem
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return err
+		}
+
+		room.Lists[e.PlayerID] = append(room.Lists[e.PlayerID], ListItem(payload))
+
+	case RoomEventListRemoved:
+		var payload MessageListRemove
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return err
+		}
+
+		room.Lists[e.PlayerID] = slices.DeleteFunc(room.Lists[e.PlayerID], func(v ListItem) bool {
+			return v.ID == payload.ID
+		})
+
+	case RoomEventVoted:
+		var payload MessageVote
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return err
+		}
+
+		for i, candidate := range room.Candidates {
+			if candidate.ID == payload.ID {
+				room.Candidates[i].Voters = append(room.Candidates[i].Voters, e.PlayerID)
+				if payload.Vote {
+					room.Candidates[i].Score++
+				}
+			}
+		}
+
+		user := room.Players[e.PlayerID]
+		if len(collectRemainingCandidates(user, *room)) == 0 {
+			user.Ready = true
+			room.Players[user.ID] = user
+		}
+
+	default:
+		return fmt.Errorf("Unknown room event %q", e.Type)
+	}
+
+	room.LastEventSeq = e.Seq
+	room.LastActivityAt = e.At
+
+	return nil
+}
+
+// ReplayRoom rebuilds a room from its log, applying only events that
+// happened at or before until. It returns the number of events applied.
+func ReplayRoom(events []RoomEvent, until time.Time) (*Room, int, error) {
+	if len(events) == 0 || events[0].Type != RoomEventCreated {
+		return nil, 0, fmt.Errorf("Room log doesn't start with %q event", RoomEventCreated)
+	}
+
+	room := NewRoom()
+	room.ID = events[0].RoomID
+
+	var timerSetAt time.Time
+	applied := 0
+	for _, e := range events {
+		if e.At.After(until) {
+			break
+		}
+
+		if err := room.Apply(e); err != nil {
+			return nil, applied, fmt.Errorf("Failed to apply event %d: %w", e.Seq, err)
+		}
+		if e.Type == RoomEventTimerSet {
+			timerSetAt = e.At
+		}
+		applied++
+	}
+
+	// Timer ticks aren't recorded, derive what's left of the last one set.
+	if room.Time > 0 {
+		elapsed := until.Sub(timerSetAt).Truncate(time.Second)
+		room.Time = max(room.Time-elapsed, 0)
+	}
+
+	return &room, applied, nil
+}
+
+// HandleRoomReplay serves the room as it was at the time in the "at" query
+// parameter, now by default, along with the events that made it
+func HandleRoomReplay(roomEvents RoomEventStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		until := time.Now()
+		if at := r.URL.Query().Get("at"); at != "" {
+			var err error
+			until, err = time.Parse(time.RFC3339, at)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		events := roomEvents.Events(r.PathValue("id"))
+		if len(events) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		room, applied, err := ReplayRoom(events, until)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"at":     until,
+			"room":   room,
+			"events": events[:applied],
+		})
+	}
+}
+
+type RoomEventStore interface {
+	Append(events ...RoomEvent)
+	// Events returns the room log ordered by Seq.
+	Events(roomID string) []RoomEvent
+}
+
+type InMemoryRoomEventStore struct {
+	lock   *sync.RWMutex
+	events map[string][]RoomEvent
+}
+
+func NewInMemoryRoomEventStore() *InMemoryRoomEventStore {
+	return &InMemoryRoomEventStore{
+		lock:   &sync.RWMutex{},
+		events: make(map[string][]RoomEvent),
+	}
+}
+
+func (s *InMemoryRoomEventStore) Append(events ...RoomEvent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, e := range events {
+		roomLog := s.events[e.RoomID]
+		i, _ := slices.BinarySearchFunc(roomLog, e.Seq, func(v RoomEvent, seq int) int {
+			return v.Seq - seq
+		})
+		s.events[e.RoomID] = slices.Insert(roomLog, i, e)
+	}
+}
+
+func (s *InMemoryRoomEventStore) Events(roomID string) []RoomEvent {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return slices.Clone(s.events[roomID])
+}
+
+func (s *InMemoryRoomEventStore) AllEvents() []RoomEvent {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var events []RoomEvent
+	for _, roomLog := range s.events {
+		events = append(events, roomLog...)
+	}
+
+	return events
+}
+
+const sqliteRoomEventsSchema = `
+CREATE TABLE IF NOT EXISTS room_events (
+	room_id   TEXT NOT NULL,
+	seq       INTEGER NOT NULL,
+	type      TEXT NOT NULL,
+	player_id TEXT NOT NULL,
+	payload   BLOB,
+	at        TIMESTAMP NOT NULL,
+	PRIMARY KEY (room_id, seq)
+);
+`
+
+type SQLiteRoomEventStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteRoomEventStore(db *sql.DB) (*SQLiteRoomEventStore, error) {
+	if _, err := db.Exec(sqliteRoomEventsSchema); err != nil {
+		return nil, err
+	}
+
+	return &SQLiteRoomEventStore{db: db}, nil
+}
+
+func (s *SQLiteRoomEventStore) Append(events ...RoomEvent) {
+	for _, e := range events {
+		_, err := s.db.Exec(
+			`INSERT INTO room_events (room_id, seq, type, player_id, payload, at)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			e.RoomID, e.Seq, e.Type, e.PlayerID, []byte(e.Payload), e.At,
+		)
+		if err != nil {
+			log.Printf("in SQLiteRoomEventStore.Append. Failed to append event %d to room %s: %s", e.Seq, e.RoomID, err.Error())
+		}
+	}
+}
+
+func (s *SQLiteRoomEventStore) Events(roomID string) []RoomEvent {
+	var events []RoomEvent
+	err := queryEach(s.db, `SELECT seq, type, player_id, payload, at
+		FROM room_events WHERE room_id = ? ORDER BY seq`,
+		func(rows *sql.Rows) error {
+			e := RoomEvent{RoomID: roomID}
+			var payload []byte
+			if err := rows.Scan(&e.Seq, &e.Type, &e.PlayerID, &payload, &e.At); err != nil {
+				return err
+			}
+			e.Payload = payload
+			events = append(events, e)
+
+			return nil
+		},
+		roomID,
+	)
+	if err != nil {
+		log.Printf("in SQLiteRoomEventStore.Events. Failed to load events of room %s: %s", roomID, err.Error())
+		return nil
+	}
+
+	return events
+}
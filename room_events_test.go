@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// playRound records a room through the handlers: players join, set a
+// timer, list movies, vote and one of them leaves
+func playRound(t *testing.T) *testRoom {
+	t.Helper()
+
+	r := newTestRoom(t)
+	players := joinPlayers(r, "a", "b", "c")
+	a, b, c := players[0], players[1], players[2]
+
+	a.send(MessageTypeSetTimer, MessageSetTimer{TimeInSeconds: 60})
+	for _, p := range players {
+		p.expect(EventTypeTimerSet)
+	}
+	b.send(MessageTypePresence, MessagePresence{Presence: "idle"})
+	for _, p := range players {
+		p.expect(EventTypePlayersChanged)
+	}
+
+	a.send(MessageTypeListAdd, MessageListAdd{TMDBMovie{ID: 1, Title: "First"}})
+	a.expect(EventTypeListChanged)
+	b.send(MessageTypeListAdd, MessageListAdd{TMDBMovie{ID: 2, Title: "Second"}})
+	b.expect(EventTypeListChanged)
+
+	a.send(MessageTypeNextStage, nil)
+	for _, p := range players {
+		p.expect(EventTypePlayerUpdated, EventTypePlayersChanged, EventTypeStageVoting)
+	}
+	a.send(MessageTypeVote, MessageVote{ID: "1", Vote: true})
+	a.expect(EventTypeVoteRegistered)
+
+	c.disconnect()
+	a.expect(EventTypePlayersChanged)
+	b.expect(EventTypePlayersChanged)
+
+	return r
+}
+
+func findEvent(events []RoomEvent, eventType string) RoomEvent {
+	for _, e := range events {
+		if e.Type == eventType {
+			return e
+		}
+	}
+
+	return RoomEvent{}
+}
+
+func TestReplayRoom(t *testing.T) {
+	r := playRound(t)
+	live := r.rooms.Find(r.ID)
+	events := r.events.Events(r.ID)
+	timerSet := findEvent(events, RoomEventTimerSet)
+
+	replayed, applied, err := ReplayRoom(events, events[len(events)-1].At)
+	if err != nil {
+		t.Fatalf("Failed to replay: %s", err.Error())
+	}
+	if applied != len(events) {
+		t.Fatalf("Expected all %d events to be applied, got %d", len(events), applied)
+	}
+	// only updates bump the version, replay doesn't
+	replayed.Version = live.Version
+	if !reflect.DeepEqual(replayed, live) {
+		t.Fatalf("Expected replay to reproduce\n%+v\ngot\n%+v", live, replayed)
+	}
+
+	// the timer isn't ticked by events, what's left comes from the time
+	replayed, _, err = ReplayRoom(events, timerSet.At.Add(25*time.Second+500*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to replay: %s", err.Error())
+	}
+	if replayed.Time != 35*time.Second {
+		t.Fatalf("Expected 35s left on the timer, got %s", replayed.Time)
+	}
+	replayed, _, _ = ReplayRoom(events, timerSet.At.Add(2*time.Minute))
+	if replayed.Time != 0 {
+		t.Fatalf("Expected the timer to be over, got %s", replayed.Time)
+	}
+
+	// right before voting started
+	stageChanged := findEvent(events, RoomEventStageChanged)
+	replayed, applied, err = ReplayRoom(events, stageChanged.At.Add(-time.Nanosecond))
+	if err != nil {
+		t.Fatalf("Failed to replay: %s", err.Error())
+	}
+	if replayed.Stage != StageLobby || len(replayed.Candidates) != 0 || len(replayed.Players) != 3 {
+		t.Fatalf("Expected 3 players in the lobby, got %+v", replayed)
+	}
+	if replayed.LastEventSeq != events[applied-1].Seq || events[applied].Seq != stageChanged.Seq {
+		t.Fatalf("Expected replay to stop at event %d, stopped after %d", stageChanged.Seq, replayed.LastEventSeq)
+	}
+}
+
+func TestReplayPresenceAfterLeave(t *testing.T) {
+	at := time.Date(2024, 5, 1, 18, 30, 0, 0, time.UTC)
+	room := NewRoom()
+	event := func(seq int, eventType string, playerID string, payload any) RoomEvent {
+		raw, _ := json.Marshal(payload)
+		return RoomEvent{
+			RoomID:   room.ID,
+			Seq:      seq,
+			Type:     eventType,
+			PlayerID: playerID,
+			Payload:  raw,
+			At:       at.Add(time.Duration(seq) * time.Second),
+		}
+	}
+	events := []RoomEvent{
+		event(1, RoomEventCreated, "", nil),
+		event(2, RoomEventJoined, "a", roomEventJoined{Name: "a"}),
+		event(3, RoomEventJoined, "b", roomEventJoined{Name: "b"}),
+		event(4, RoomEventLeft, "b", roomEventLeft{}),
+		// b's connection was found away after b left
+		event(5, RoomEventPresenceChanged, "b", roomEventPresenceChanged{Presence: "away"}),
+	}
+
+	replayed, applied, err := ReplayRoom(events, at.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to replay: %s", err.Error())
+	}
+	if applied != len(events) || len(replayed.Players) != 1 || replayed.LastEventSeq != 5 {
+		t.Fatalf("Expected only a after all events, got %+v after %d events", replayed, applied)
+	}
+}
+
+func TestHandleRoomReplay(t *testing.T) {
+	r := playRound(t)
+	events := r.events.Events(r.ID)
+	handler := HandleRoomReplay(r.events)
+
+	get := func(id string, at string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/room/"+id+"/replay?at="+at, nil)
+		req.SetPathValue("id", id)
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		return w
+	}
+
+	w := get(r.ID, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var replay struct {
+		Room   Room        `json:"room"`
+		Events []RoomEvent `json:"events"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &replay); err != nil {
+		t.Fatalf("Failed to decode replay: %s", err.Error())
+	}
+	if len(replay.Events) != len(events) || replay.Room.Stage != StageVoting || len(replay.Room.Players) != 2 {
+		t.Fatalf("Expected 2 players voting after %d events, got %+v after %d", len(events), replay.Room, len(replay.Events))
+	}
+
+	if w := get(r.ID, "yesterday"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad time, got %d", w.Code)
+	}
+	if w := get("missing", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing room, got %d", w.Code)
+	}
+}
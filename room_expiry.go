@@ -0,0 +1,55 @@
+package main
+
+import "time"
+
+const (
+	ExpiryReasonIdle     = "idle"
+	ExpiryReasonMaxAge   = "max_age"
+	ExpiryReasonEmpty    = "empty"
+	ExpiryReasonFinished = "finished"
+)
+
+// ExpiryPolicy decides when rooms are closed. A zero duration disables the
+// corresponding rule.
+type ExpiryPolicy struct {
+	// IdleTTL is how long a room may go without player activity
+	IdleTTL time.Duration
+	// MaxAge is how long a room may exist at all
+	MaxAge time.Duration
+	// EmptyGrace is how long a room is kept once its last player left,
+	// or after creation if nobody ever joined
+	EmptyGrace time.Duration
+	// FinishedRetention is how long a room is kept after results are shown
+	FinishedRetention time.Duration
+
+	CheckInterval time.Duration
+}
+
+var DefaultExpiryPolicy = ExpiryPolicy{
+	IdleTTL:           2 * time.Hour,
+	MaxAge:            24 * time.Hour,
+	EmptyGrace:        5 * time.Minute,
+	FinishedRetention: 30 * time.Minute,
+
+	CheckInterval: time.Minute,
+}
+
+// Expired reports whether the room should be closed at now, and why.
+func (p ExpiryPolicy) Expired(room Room, now time.Time) (string, bool) {
+	expired := func(ttl time.Duration, since time.Time) bool {
+		return ttl > 0 && !since.IsZero() && now.Sub(since) >= ttl
+	}
+
+	switch {
+	case expired(p.EmptyGrace, room.EmptySince):
+		return ExpiryReasonEmpty, true
+	case expired(p.FinishedRetention, room.FinishedAt):
+		return ExpiryReasonFinished, true
+	case expired(p.IdleTTL, room.LastActivityAt):
+		return ExpiryReasonIdle, true
+	case expired(p.MaxAge, room.CreatedAt):
+		return ExpiryReasonMaxAge, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// InstrumentedRoomsRepository wraps any RoomsRepository and keeps
+// per-operation counters that can be read with Metrics.
+type InstrumentedRoomsRepository struct {
+	rooms RoomsRepository
+	// updateFn callbacks running longer than this are logged
+	slowUpdate time.Duration
+
+	add, find, update, compareAndUpdate, delete, ids opMetrics
+	slowUpdates                                      atomic.Int64
+}
+
+type opMetrics struct {
+	calls       atomic.Int64
+	errors      atomic.Int64
+	latency     atomic.Int64
+	maxLatency  atomic.Int64
+	lockWait    atomic.Int64
+	maxLockWait atomic.Int64
+}
+
+func NewInstrumentedRoomsRepository(rooms RoomsRepository, slowUpdate time.Duration) *InstrumentedRoomsRepository {
+	return &InstrumentedRoomsRepository{
+		rooms:      rooms,
+		slowUpdate: slowUpdate,
+	}
+}
+
+// triggeredUpdater is implemented by repositories that want to know which
+// message caused an update.
+type triggeredUpdater interface {
+	UpdateTriggeredBy(trigger string, id string, updateFn func(*Room) error) error
+}
+
+// updateTriggeredBy falls back to a plain Update for repositories that
+// don't care about triggers.
+func updateTriggeredBy(rooms RoomsRepository, trigger string, id string, updateFn func(*Room) error) error {
+	if u, ok := rooms.(triggeredUpdater); ok {
+		return u.UpdateTriggeredBy(trigger, id, updateFn)
+	}
+
+	return rooms.Update(id, updateFn)
+}
+
+func (r *InstrumentedRoomsRepository) Add(room Room) {
+	defer r.add.observe(time.Now(), nil)
+
+	r.rooms.Add(room)
+}
+
+func (r *InstrumentedRoomsRepository) Find(id string) *Room {
+	defer r.find.observe(time.Now(), nil)
+
+	return r.rooms.Find(id)
+}
+
+func (r *InstrumentedRoomsRepository) Update(id string, updateFn func(*Room) error) error {
+	return r.UpdateTriggeredBy("", id, updateFn)
+}
+
+func (r *InstrumentedRoomsRepository) UpdateTriggeredBy(trigger string, id string, updateFn func(*Room) error) error {
+	start := time.Now()
+	err := r.rooms.Update(id, r.instrument(&r.update, start, trigger, id, updateFn))
+	r.update.observe(start, err)
+
+	return err
+}
+
+func (r *InstrumentedRoomsRepository) CompareAndUpdate(id string, version int, updateFn func(*Room) error) error {
+	start := time.Now()
+	err := r.rooms.CompareAndUpdate(id, version, r.instrument(&r.compareAndUpdate, start, "", id, updateFn))
+	r.compareAndUpdate.observe(start, err)
+
+	return err
+}
+
+func (r *InstrumentedRoomsRepository) Delete(id string) {
+	defer r.delete.observe(time.Now(), nil)
+
+	r.rooms.Delete(id)
+}
+
+func (r *InstrumentedRoomsRepository) IDs() []string {
+	defer r.ids.observe(time.Now(), nil)
+
+	return r.rooms.IDs()
+}
+
+// instrument measures the time until the backend hands out the room, which
+// is how long the update waited for its lock, and the callback itself.
+func (r *InstrumentedRoomsRepository) instrument(
+	op *opMetrics,
+	start time.Time,
+	trigger string,
+	id string,
+	updateFn func(*Room) error,
+) func(*Room) error {
+	return func(room *Room) error {
+		called := time.Now()
+		wait := called.Sub(start)
+		op.lockWait.Add(int64(wait))
+		storeMax(&op.maxLockWait, int64(wait))
+
+		err := updateFn(room)
+
+		if took := time.Since(called); r.slowUpdate > 0 && took > r.slowUpdate {
+			r.slowUpdates.Add(1)
+			if trigger == "" {
+				trigger = "unknown"
+			}
+			log.Printf("in InstrumentedRoomsRepository. Slow update of room %s triggered by %q took %s", id, trigger, took)
+		}
+
+		return err
+	}
+}
+
+func (m *opMetrics) observe(start time.Time, err error) {
+	took := int64(time.Since(start))
+
+	m.calls.Add(1)
+	m.latency.Add(took)
+	storeMax(&m.maxLatency, took)
+	if err != nil {
+		m.errors.Add(1)
+	}
+}
+
+func storeMax(v *atomic.Int64, n int64) {
+	for {
+		current := v.Load()
+		if n <= current || v.CompareAndSwap(current, n) {
+			return
+		}
+	}
+}
+
+type OpMetrics struct {
+	Calls         int64   `json:"calls"`
+	Errors        int64   `json:"errors"`
+	AvgLatencyMs  float64 `json:"avg_latency_ms"`
+	MaxLatencyMs  float64 `json:"max_latency_ms"`
+	AvgLockWaitMs float64 `json:"avg_lock_wait_ms,omitempty"`
+	MaxLockWaitMs float64 `json:"max_lock_wait_ms,omitempty"`
+}
+
+type RoomsRepositoryMetrics struct {
+	Rooms       int                  `json:"rooms"`
+	SlowUpdates int64                `json:"slow_updates"`
+	Ops         map[string]OpMetrics `json:"ops"`
+}
+
+func (r *InstrumentedRoomsRepository) Metrics() RoomsRepositoryMetrics {
+	return RoomsRepositoryMetrics{
+		// not through r.IDs, reading metrics shouldn't show up in them
+		Rooms:       len(r.rooms.IDs()),
+		SlowUpdates: r.slowUpdates.Load(),
+		Ops: map[string]OpMetrics{
+			"add":                r.add.snapshot(),
+			"find":               r.find.snapshot(),
+			"update":             r.update.snapshot(),
+			"compare_and_update": r.compareAndUpdate.snapshot(),
+			"delete":             r.delete.snapshot(),
+			"ids":                r.ids.snapshot(),
+		},
+	}
+}
+
+func (m *opMetrics) snapshot() OpMetrics {
+	calls := m.calls.Load()
+	metrics := OpMetrics{
+		Calls:         calls,
+		Errors:        m.errors.Load(),
+		MaxLatencyMs:  toMs(m.maxLatency.Load()),
+		MaxLockWaitMs: toMs(m.maxLockWait.Load()),
+	}
+	if calls > 0 {
+		metrics.AvgLatencyMs = toMs(m.latency.Load() / calls)
+		metrics.AvgLockWaitMs = toMs(m.lockWait.Load() / calls)
+	}
+
+	return metrics
+}
+
+func toMs(d int64) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
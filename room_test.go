@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newBenchmarkRooms(b *testing.B, n int) (*InMemoryRoomsRepository, []string) {
+	b.Helper()
+
+	repo := NewInMemoryRoomsRepository()
+	ids := make([]string, n)
+	for i := range ids {
+		room := NewRoom()
+		for j := 0; j < 8; j++ {
+			id := fmt.Sprintf("player-%d", j)
+			room.Players[id] = Player{ID: id, Name: id}
+		}
+
+		repo.Add(room)
+		ids[i] = room.ID
+	}
+
+	return repo, ids
+}
+
+// Every goroutine updates rooms round-robin, building the same event a
+// handler would broadcast. With per-room locks throughput should grow with
+// the number of rooms instead of staying flat.
+func BenchmarkInMemoryRoomsRepositoryUpdate(b *testing.B) {
+	for _, n := range []int{1, 10, 100, 500} {
+		b.Run(fmt.Sprintf("rooms=%d", n), func(b *testing.B) {
+			repo, ids := newBenchmarkRooms(b, n)
+			var next atomic.Uint64
+
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					id := ids[next.Add(1)%uint64(n)]
+					repo.Update(id, func(room *Room) error {
+						p := room.Players["player-0"]
+						p.Ready = !p.Ready
+						room.Players[p.ID] = p
+						NewEventPlayersChanged(*room)
+
+						return nil
+					})
+				}
+			})
+		})
+	}
+}
+
+// A timer tick, with reads and updates spread over hundreds of rooms.
+func BenchmarkInMemoryRoomsRepositoryMixed(b *testing.B) {
+	repo, ids := newBenchmarkRooms(b, 500)
+	var next atomic.Uint64
+
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := next.Add(1)
+			id := ids[i%uint64(len(ids))]
+			if i%4 == 0 {
+				repo.Update(id, func(room *Room) error {
+					room.Time++
+					return nil
+				})
+			} else {
+				repo.Find(id)
+			}
+		}
+	})
+}
+
+// One room is stuck in slow updates, e.g. broadcasting to a stalled client,
+// while hundreds of other rooms keep being updated.
+func BenchmarkInMemoryRoomsRepositoryBusyRoom(b *testing.B) {
+	repo, ids := newBenchmarkRooms(b, 500)
+	busy, others := ids[0], ids[1:]
+
+	stop := make(chan struct{})
+	defer close(stop)
+	started := make(chan struct{})
+	var once sync.Once
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				repo.Update(busy, func(room *Room) error {
+					once.Do(func() { close(started) })
+					time.Sleep(time.Millisecond)
+					return nil
+				})
+			}
+		}
+	}()
+	<-started
+
+	var next atomic.Uint64
+
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			id := others[next.Add(1)%uint64(len(others))]
+			repo.Update(id, func(room *Room) error {
+				room.Time++
+				return nil
+			})
+		}
+	})
+}
+
+// Rooms found are read while the stored room keeps being updated, run with
+// -race to catch shared maps and slices.
+func TestInMemoryRoomsRepositoryFindWhileUpdating(t *testing.T) {
+	repo := NewInMemoryRoomsRepository()
+	room := NewRoom()
+	repo.Add(room)
+
+	const updates = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < updates; i++ {
+			repo.Update(room.ID, func(r *Room) error {
+				id := fmt.Sprintf("player-%d", i)
+				r.Players[id] = Player{ID: id, Name: id}
+				r.Lists[id] = append(r.Lists[id], ListItem{ID: id})
+				r.Candidates = append(r.Candidates, Candidate{ListItem: ListItem{ID: id}})
+				for j := range r.Candidates {
+					r.Candidates[j].Voters = append(r.Candidates[j].Voters, id)
+				}
+				return nil
+			})
+		}
+	}()
+
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+
+		found := repo.Find(room.ID)
+		for id, p := range found.Players {
+			_ = p.Name + fmt.Sprint(len(found.Lists[id]))
+		}
+		for _, c := range found.Candidates {
+			_ = len(c.Voters)
+		}
+	}
+
+	found := repo.Find(room.ID)
+	if len(found.Players) != updates || len(found.Candidates[0].Voters) != updates {
+		t.Fatalf("Expected %d players and voters, got %d and %d", updates, len(found.Players), len(found.Candidates[0].Voters))
+	}
+}
+
+func TestInMemoryRoomsRepositoryFailedUpdate(t *testing.T) {
+	repo := NewInMemoryRoomsRepository()
+	room := NewRoom()
+	room.Players["a"] = Player{ID: "a", Name: "a"}
+	room.Candidates = []Candidate{{ListItem: ListItem{ID: "1"}, Voters: []string{}}}
+	repo.Add(room)
+
+	err := repo.Update(room.ID, func(r *Room) error {
+		r.Players["b"] = Player{ID: "b", Name: "b"}
+		r.Lists["a"] = []ListItem{{ID: "2"}}
+		r.Candidates[0].Voters = append(r.Candidates[0].Voters, "a")
+		r.Candidates[0].Score++
+		return errors.New("Failed halfway")
+	})
+	if err == nil {
+		t.Fatal("Expected the update to fail")
+	}
+
+	found := repo.Find(room.ID)
+	candidate := found.Candidates[0]
+	if len(found.Players) != 1 || len(found.Lists) != 0 || len(candidate.Voters) != 0 || candidate.Score != 0 {
+		t.Fatalf("Expected failed update to change nothing, got %+v", found)
+	}
+}
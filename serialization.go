@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"log"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
 
 	t "stmsh/pkg/templates"
 	"stmsh/pkg/ws"
@@ -11,19 +17,104 @@ import (
 
 type JsonSerializer struct{}
 
-func (s *JsonSerializer) Serialize(message ws.MessageOutgoing) (messageType int, serialized [][]byte) {
+func (s *JsonSerializer) Serialize(seq int, message ws.MessageOutgoing) (messageType int, serialized [][]byte) {
 	messageType = websocket.TextMessage
 	msg, err := json.Marshal(message)
-	if err == nil {
-		serialized = append(serialized, msg)
+	if err != nil {
+		return
 	}
 
+	// every event is an object, seq goes in front of its fields
+	if seq > 0 && len(msg) > 1 && msg[0] == '{' {
+		withSeq := fmt.Appendf(nil, `{"seq":%d`, seq)
+		if msg[1] != '}' {
+			withSeq = append(withSeq, ',')
+		}
+		msg = append(withSeq, msg[1:]...)
+	}
+	serialized = append(serialized, msg)
+
 	return
 }
 
+// MsgpackSerializer sends the same events as JsonSerializer, field names
+// included, in binary frames.
+type MsgpackSerializer struct{}
+
+func (s *MsgpackSerializer) Serialize(seq int, message ws.MessageOutgoing) (messageType int, serialized [][]byte) {
+	messageType = websocket.BinaryMessage
+
+	buff := bytes.Buffer{}
+	enc := msgpack.NewEncoder(&buff)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(message); err != nil {
+		log.Printf("in MsgpackSerializer.Serialize. Failed to encode %T: %s", message, err.Error())
+		return
+	}
+
+	msg := buff.Bytes()
+	if seq > 0 {
+		msg = msgpackPrependSeq(msg, seq)
+	}
+	serialized = append(serialized, msg)
+
+	return
+}
+
+// msgpackPrependSeq adds seq as the first entry of an encoded map, the way
+// JsonSerializer does for objects
+func msgpackPrependSeq(encoded []byte, seq int) []byte {
+	var n, header int
+	switch {
+	case len(encoded) > 0 && encoded[0]&0xf0 == 0x80:
+		n, header = int(encoded[0]&0x0f), 1
+	case len(encoded) > 2 && encoded[0] == 0xde:
+		n, header = int(binary.BigEndian.Uint16(encoded[1:])), 3
+	case len(encoded) > 4 && encoded[0] == 0xdf:
+		n, header = int(binary.BigEndian.Uint32(encoded[1:])), 5
+	default:
+		return encoded
+	}
+
+	buff := bytes.Buffer{}
+	enc := msgpack.NewEncoder(&buff)
+	enc.UseCompactInts(true)
+	enc.EncodeMapLen(n + 1)
+	enc.EncodeString("seq")
+	enc.EncodeInt(int64(seq))
+	buff.Write(encoded[header:])
+
+	return buff.Bytes()
+}
+
+// Decode reads incoming messages encoded like JSON ones. Handlers expect
+// JSON payloads, so the payload is converted.
+func (s *MsgpackSerializer) Decode(data []byte) (ws.MessageIncoming, error) {
+	var raw struct {
+		ID      string `msgpack:"id"`
+		Type    string `msgpack:"type"`
+		Payload any    `msgpack:"payload"`
+	}
+	if err := msgpack.Unmarshal(data, &raw); err != nil {
+		return ws.MessageIncoming{}, err
+	}
+
+	msg := ws.MessageIncoming{ID: raw.ID, Type: raw.Type}
+	if raw.Payload != nil {
+		payload, err := json.Marshal(raw.Payload)
+		if err != nil {
+			return msg, err
+		}
+		msg.Payload = payload
+	}
+
+	return msg, nil
+}
+
 type HtmxSerializer struct{}
 
-func (s *HtmxSerializer) Serialize(message ws.MessageOutgoing) (messageType int, serialized [][]byte) {
+func (s *HtmxSerializer) Serialize(seq int, message ws.MessageOutgoing) (messageType int, serialized [][]byte) {
 	messageType = websocket.TextMessage
 
 	switch event := message.(type) {
@@ -72,7 +163,50 @@ func (s *HtmxSerializer) Serialize(message ws.MessageOutgoing) (messageType int,
 		serialized = append(serialized, t.Render("stage_results", event))
 		serialized = append(serialized, t.Render("results_winners", event.Winners))
 		serialized = append(serialized, t.Render("results_others", event.Others))
+
+	case EventUpgradeToken:
+		serialized = append(serialized, t.Render("upgrade_token", event.Token))
+
+	case ws.Ack:
+		serialized = append(serialized, t.Render("reply_ack", event))
+	case ws.Error:
+		if event.ID != "" {
+			serialized = append(serialized, t.Render("reply_error", event))
+		}
+		serialized = append(serialized, t.Render("toast", event))
+
+	case EventRoomClosed:
+		serialized = append(serialized, t.Render("time", time.Duration(0)))
+		serialized = append(serialized, t.Render("actions_results", nil))
+		serialized = append(serialized, t.Render("stage_closed", event))
+	}
+
+	// the page sends the last seq it saw when it rejoins
+	if seq > 0 && len(serialized) > 0 {
+		last := len(serialized) - 1
+		serialized[last] = append(serialized[last], t.Render("seq", seq)...)
 	}
 
 	return
 }
+
+// NewEventCodec knows every event handlers broadcast, so they can cross the
+// backplane
+func NewEventCodec() *ws.MessageCodec {
+	codec := ws.NewMessageCodec()
+	codec.Register(EventTypeRoomInit, EventRoomInit{})
+	codec.Register(EventTypePlayerJoined, EventPlayerJoined{})
+	codec.Register(EventTypePlayersChanged, EventPlayersChanged{})
+	codec.Register(EventTypeHostChanged, EventHostChanged{})
+	codec.Register(EventTypeTimerSet, EventTimerSet{})
+	codec.Register(EventTypeRoomTime, EventRoomTime{})
+	codec.Register(EventTypeStageVoting, EventStageVoting{})
+	codec.Register(EventTypeVoteRegistered, EventVoteRegistered{})
+	codec.Register(EventTypeStageResults, EventStageResults{})
+	codec.Register(EventTypeRoomClosed, EventRoomClosed{})
+	codec.Register(EventTypePlayerUpdated, EventPlayerUpdated{})
+	codec.Register(EventTypeListChanged, EventListChanged{})
+	codec.Register(EventTypeUpgradeToken, EventUpgradeToken{})
+
+	return codec
+}
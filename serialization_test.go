@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// msgpackKeys decodes an encoded map keeping the order of its keys
+func msgpackKeys(t *testing.T, encoded []byte) ([]string, map[string]any) {
+	t.Helper()
+
+	dec := msgpack.NewDecoder(bytes.NewReader(encoded))
+	n, err := dec.DecodeMapLen()
+	if err != nil {
+		t.Fatalf("Failed to decode map: %s", err.Error())
+	}
+
+	keys := make([]string, 0, n)
+	values := make(map[string]any, n)
+	for range n {
+		key, err := dec.DecodeString()
+		if err != nil {
+			t.Fatalf("Failed to decode key: %s", err.Error())
+		}
+		if values[key], err = dec.DecodeInterface(); err != nil {
+			t.Fatalf("Failed to decode %s: %s", key, err.Error())
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, values
+}
+
+func TestMsgpackPrependSeq(t *testing.T) {
+	// fixmap, map 16 and map 32 headers
+	for _, size := range []int{2, 16, 1 << 16} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			message := make(map[string]int, size)
+			for i := range size {
+				message[fmt.Sprint("k", i)] = i
+			}
+			encoded, err := msgpack.Marshal(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys, values := msgpackKeys(t, msgpackPrependSeq(encoded, 300))
+			if len(keys) != size+1 || keys[0] != "seq" {
+				t.Fatalf("Expected seq before %d keys, got %d keys starting with %s", size, len(keys), keys[0])
+			}
+			if fmt.Sprint(values["seq"]) != "300" {
+				t.Fatalf("Expected seq 300, got %v", values["seq"])
+			}
+			for key, value := range message {
+				if fmt.Sprint(values[key]) != fmt.Sprint(value) {
+					t.Fatalf("Expected %s to be %d, got %v", key, value, values[key])
+				}
+			}
+		})
+	}
+
+	// like JSON, only objects get a seq
+	encoded, _ := msgpack.Marshal([]string{"a", "b"})
+	if !bytes.Equal(msgpackPrependSeq(encoded, 1), encoded) {
+		t.Fatal("Expected an array to be left alone")
+	}
+}
+
+func TestMsgpackSerializer(t *testing.T) {
+	s := &MsgpackSerializer{}
+	room := NewRoom()
+	room.Time = 90 * time.Second
+	_, serialized := s.Serialize(7, NewTimerSetEvent(room))
+	if len(serialized) != 1 {
+		t.Fatalf("Expected one frame, got %d", len(serialized))
+	}
+
+	keys, values := msgpackKeys(t, serialized[0])
+	if keys[0] != "seq" || values["type"] != EventTypeTimerSet {
+		t.Fatalf("Expected seq first and type %s, got %v", EventTypeTimerSet, values)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type snapshot struct {
+	Rooms   []Room         `json:"rooms"`
+	Events  []RoomEvent    `json:"events"`
+	Archive []ArchivedRoom `json:"archive"`
+}
+
+// MemoryStorage is the part of Storage that lives in process memory
+type MemoryStorage struct {
+	Rooms   *InMemoryRoomsRepository
+	Events  *InMemoryRoomEventStore
+	Archive *InMemoryRoomArchive
+}
+
+// SaveSnapshot writes every room, its log and the archive to path. The file
+// is replaced atomically so a crash mid-write never leaves a truncated
+// snapshot.
+func SaveSnapshot(path string, storage MemoryStorage) error {
+	data, err := json.Marshal(snapshot{
+		Rooms:   storage.Rooms.Rooms(),
+		Events:  storage.Events.AllEvents(),
+		Archive: storage.Archive.All(),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot restores rooms saved by SaveSnapshot. A missing file isn't
+// an error, there's just nothing to restore.
+func LoadSnapshot(path string, storage MemoryStorage) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return 0, err
+	}
+
+	for _, room := range s.Rooms {
+		if room.Players == nil {
+			room.Players = make(map[string]Player)
+		}
+		if room.Lists == nil {
+			room.Lists = make(map[string][]ListItem)
+		}
+		storage.Rooms.Add(room)
+	}
+	storage.Events.Append(s.Events...)
+	for _, room := range s.Archive {
+		storage.Archive.Add(room)
+	}
+
+	return len(s.Rooms), nil
+}
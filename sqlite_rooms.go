@@ -0,0 +1,439 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteRoomsSchema = `
+CREATE TABLE IF NOT EXISTS rooms (
+	id               TEXT PRIMARY KEY,
+	host_id          TEXT NOT NULL,
+	stage            TEXT NOT NULL,
+	time             INTEGER NOT NULL,
+	last_event_seq   INTEGER NOT NULL DEFAULT 0,
+	version          INTEGER NOT NULL DEFAULT 0,
+	created_at       TIMESTAMP NOT NULL,
+	last_activity_at TIMESTAMP NOT NULL,
+	empty_since      TIMESTAMP,
+	finished_at      TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS players (
+	room_id  TEXT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	id       TEXT NOT NULL,
+	name     TEXT NOT NULL,
+	ready    INTEGER NOT NULL,
+	presence TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (room_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS list_items (
+	room_id      TEXT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	player_id    TEXT NOT NULL,
+	position     INTEGER NOT NULL,
+	id           TEXT NOT NULL,
+	title        TEXT NOT NULL,
+	overview     TEXT NOT NULL,
+	rating       REAL NOT NULL,
+	release_date TIMESTAMP NOT NULL,
+	poster_path  TEXT NOT NULL,
+	PRIMARY KEY (room_id, player_id, position)
+);
+
+CREATE TABLE IF NOT EXISTS candidates (
+	room_id      TEXT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	position     INTEGER NOT NULL,
+	id           TEXT NOT NULL,
+	title        TEXT NOT NULL,
+	overview     TEXT NOT NULL,
+	rating       REAL NOT NULL,
+	release_date TIMESTAMP NOT NULL,
+	poster_path  TEXT NOT NULL,
+	suggested_by TEXT NOT NULL,
+	score        INTEGER NOT NULL,
+	PRIMARY KEY (room_id, position)
+);
+
+CREATE TABLE IF NOT EXISTS candidate_voters (
+	room_id            TEXT NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	candidate_position INTEGER NOT NULL,
+	position           INTEGER NOT NULL,
+	voter_id           TEXT NOT NULL,
+	PRIMARY KEY (room_id, candidate_position, position)
+);
+`
+
+// sqlQuerier is implemented by both *sql.DB and *sql.Tx
+type sqlQuerier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+type SQLiteRoomsRepository struct {
+	db *sql.DB
+}
+
+func NewSQLiteRoomsRepository(path string) (*SQLiteRoomsRepository, error) {
+	// Immediate transactions take the write lock up front, so instances
+	// sharing the file wait for each other instead of updating stale rooms
+	dsn := fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate", path)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Writes are serialized by sqlite anyway. A single connection keeps
+	// transactions from failing with SQLITE_BUSY inside the process.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteRoomsSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// databases from before presence was tracked don't have the column
+	if err := addColumnIfMissing(db, "players", "presence", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteRoomsRepository{db: db}, nil
+}
+
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+
+	return err
+}
+
+func (r *SQLiteRoomsRepository) Close() error {
+	return r.db.Close()
+}
+
+func (r *SQLiteRoomsRepository) Add(room Room) {
+	err := r.inTx(func(tx *sql.Tx) error {
+		return saveRoom(tx, room)
+	})
+	if err != nil {
+		log.Printf("in SQLiteRoomsRepository.Add. Failed to save room %s: %s", room.ID, err.Error())
+	}
+}
+
+func (r *SQLiteRoomsRepository) Find(id string) *Room {
+	room, err := loadRoom(r.db, id)
+	if err != nil {
+		log.Printf("in SQLiteRoomsRepository.Find. Failed to load room %s: %s", id, err.Error())
+		return nil
+	}
+
+	return room
+}
+
+func (r *SQLiteRoomsRepository) Update(id string, updateFn func(room *Room) error) error {
+	return r.update(id, -1, updateFn)
+}
+
+func (r *SQLiteRoomsRepository) CompareAndUpdate(id string, version int, updateFn func(room *Room) error) error {
+	return r.update(id, version, updateFn)
+}
+
+// update checks the room version unless version is negative
+func (r *SQLiteRoomsRepository) update(id string, version int, updateFn func(room *Room) error) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		room, err := loadRoom(tx, id)
+		if err != nil {
+			return err
+		}
+		if room == nil {
+			return ErrRoomNotFound
+		}
+
+		if version >= 0 && room.Version != version {
+			return ErrRoomVersionConflict
+		}
+		loadedVersion := room.Version
+		room.Version++
+
+		if err := updateFn(room); err != nil {
+			return err
+		}
+
+		// Guards against other processes sharing the database file
+		res, err := tx.Exec(
+			`UPDATE rooms SET version = ? WHERE id = ? AND version = ?`,
+			room.Version, room.ID, loadedVersion,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrRoomVersionConflict
+		}
+
+		return saveRoom(tx, *room)
+	})
+}
+
+func (r *SQLiteRoomsRepository) Delete(id string) {
+	_, err := r.db.Exec(`DELETE FROM rooms WHERE id = ?`, id)
+	if err != nil {
+		log.Printf("in SQLiteRoomsRepository.Delete. Failed to delete room %s: %s", id, err.Error())
+	}
+}
+
+func (r *SQLiteRoomsRepository) IDs() []string {
+	var ids []string
+	err := queryEach(r.db, `SELECT id FROM rooms`,
+		func(rows *sql.Rows) error {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+
+			return nil
+		},
+	)
+	if err != nil {
+		log.Printf("in SQLiteRoomsRepository.IDs. Failed to query rooms: %s", err.Error())
+		return nil
+	}
+
+	return ids
+}
+
+func (r *SQLiteRoomsRepository) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func loadRoom(q sqlQuerier, id string) (*Room, error) {
+	room := Room{
+		ID:      id,
+		Players: make(map[string]Player),
+		Lists:   make(map[string][]ListItem),
+	}
+
+	var stage string
+	var roomTime int64
+	var emptySince, finishedAt sql.NullTime
+	err := q.QueryRow(
+		`SELECT host_id, stage, time, last_event_seq, version,
+			created_at, last_activity_at, empty_since, finished_at
+		FROM rooms WHERE id = ?`, id,
+	).Scan(
+		&room.HostID, &stage, &roomTime, &room.LastEventSeq, &room.Version,
+		&room.CreatedAt, &room.LastActivityAt, &emptySince, &finishedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	room.Stage = RoomStage(stage)
+	room.Time = time.Duration(roomTime)
+	room.EmptySince = emptySince.Time
+	room.FinishedAt = finishedAt.Time
+
+	err = queryEach(q, `SELECT id, name, ready, presence FROM players WHERE room_id = ?`,
+		func(rows *sql.Rows) error {
+			var p Player
+			if err := rows.Scan(&p.ID, &p.Name, &p.Ready, &p.Presence); err != nil {
+				return err
+			}
+			room.Players[p.ID] = p
+
+			return nil
+		},
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryEach(q, `SELECT player_id, id, title, overview, rating, release_date, poster_path
+		FROM list_items WHERE room_id = ? ORDER BY player_id, position`,
+		func(rows *sql.Rows) error {
+			var playerID string
+			var item ListItem
+			if err := rows.Scan(
+				&playerID, &item.ID, &item.Title, &item.Overview,
+				&item.Rating, &item.ReleaseDate, &item.PosterPath,
+			); err != nil {
+				return err
+			}
+			room.Lists[playerID] = append(room.Lists[playerID], item)
+
+			return nil
+		},
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryEach(q, `SELECT id, title, overview, rating, release_date, poster_path, suggested_by, score
+		FROM candidates WHERE room_id = ? ORDER BY position`,
+		func(rows *sql.Rows) error {
+			c := Candidate{Voters: []string{}}
+			if err := rows.Scan(
+				&c.ID, &c.Title, &c.Overview, &c.Rating, &c.ReleaseDate,
+				&c.PosterPath, &c.SuggestedBy, &c.Score,
+			); err != nil {
+				return err
+			}
+			room.Candidates = append(room.Candidates, c)
+
+			return nil
+		},
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryEach(q, `SELECT candidate_position, voter_id
+		FROM candidate_voters WHERE room_id = ? ORDER BY candidate_position, position`,
+		func(rows *sql.Rows) error {
+			var position int
+			var voterID string
+			if err := rows.Scan(&position, &voterID); err != nil {
+				return err
+			}
+			if position < len(room.Candidates) {
+				room.Candidates[position].Voters = append(room.Candidates[position].Voters, voterID)
+			}
+
+			return nil
+		},
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &room, nil
+}
+
+// queryEach closes rows before returning, so the single connection is free
+// for the next query.
+func queryEach(q sqlQuerier, query string, scan func(*sql.Rows) error, args ...any) error {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func saveRoom(q sqlQuerier, room Room) error {
+	_, err := q.Exec(
+		`INSERT INTO rooms (id, host_id, stage, time, last_event_seq, version,
+			created_at, last_activity_at, empty_since, finished_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			host_id = excluded.host_id,
+			stage = excluded.stage,
+			time = excluded.time,
+			last_event_seq = excluded.last_event_seq,
+			version = excluded.version,
+			created_at = excluded.created_at,
+			last_activity_at = excluded.last_activity_at,
+			empty_since = excluded.empty_since,
+			finished_at = excluded.finished_at`,
+		room.ID, room.HostID, string(room.Stage), int64(room.Time), room.LastEventSeq, room.Version,
+		room.CreatedAt, room.LastActivityAt, nullTime(room.EmptySince), nullTime(room.FinishedAt),
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"players", "list_items", "candidates", "candidate_voters"} {
+		if _, err := q.Exec(`DELETE FROM `+table+` WHERE room_id = ?`, room.ID); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range room.Players {
+		_, err := q.Exec(
+			`INSERT INTO players (room_id, id, name, ready, presence) VALUES (?, ?, ?, ?, ?)`,
+			room.ID, p.ID, p.Name, p.Ready, p.Presence,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for playerID, list := range room.Lists {
+		for i, item := range list {
+			_, err := q.Exec(
+				`INSERT INTO list_items
+				(room_id, player_id, position, id, title, overview, rating, release_date, poster_path)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				room.ID, playerID, i, item.ID, item.Title, item.Overview,
+				item.Rating, item.ReleaseDate, item.PosterPath,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, c := range room.Candidates {
+		_, err := q.Exec(
+			`INSERT INTO candidates
+			(room_id, position, id, title, overview, rating, release_date, poster_path, suggested_by, score)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			room.ID, i, c.ID, c.Title, c.Overview, c.Rating,
+			c.ReleaseDate, c.PosterPath, c.SuggestedBy, c.Score,
+		)
+		if err != nil {
+			return err
+		}
+
+		for j, voterID := range c.Voters {
+			_, err := q.Exec(
+				`INSERT INTO candidate_voters (room_id, candidate_position, position, voter_id)
+				VALUES (?, ?, ?, ?)`,
+				room.ID, i, j, voterID,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"stmsh/pkg/ws"
+)
+
+func newTestSQLiteRooms(t *testing.T, path string) *SQLiteRoomsRepository {
+	t.Helper()
+
+	repo, err := NewSQLiteRoomsRepository(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %s", path, err.Error())
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	return repo
+}
+
+// newStoredRoom has something in every column. Times are in UTC without a
+// monotonic reading, like they come out of the database.
+func newStoredRoom() Room {
+	at := time.Date(2024, 5, 1, 18, 30, 0, 0, time.UTC)
+	movie := ListItem{
+		ID:          "603",
+		Title:       "The Matrix",
+		Overview:    "A hacker learns what the world really is.",
+		Rating:      8.2,
+		ReleaseDate: time.Date(1999, 3, 31, 0, 0, 0, 0, time.UTC),
+		PosterPath:  "/matrix.jpg",
+	}
+
+	room := NewRoom()
+	room.HostID = "a"
+	room.Stage = StageVoting
+	room.Time = 90 * time.Second
+	room.LastEventSeq = 12
+	room.Version = 3
+	room.CreatedAt = at
+	room.LastActivityAt = at.Add(time.Minute)
+	room.EmptySince = time.Time{}
+	room.FinishedAt = at.Add(time.Hour)
+	room.Players = map[string]Player{
+		"a": {ID: "a", Name: "Ann", Ready: true, Presence: ws.PresenceFocused},
+		"b": {ID: "b", Name: "Bob", Presence: ws.PresenceAway},
+	}
+	room.Lists = map[string][]ListItem{
+		"a": {movie, {ID: "13", Title: "Forrest Gump", ReleaseDate: at, PosterPath: "/gump.jpg"}},
+	}
+	room.Candidates = []Candidate{
+		{ListItem: movie, SuggestedBy: "a", Score: 1, Voters: []string{"a", "b"}},
+		{ListItem: ListItem{ID: "13", Title: "Forrest Gump", ReleaseDate: at}, SuggestedBy: "a", Voters: []string{}},
+	}
+
+	return room
+}
+
+func TestSQLiteRoomsRepositoryRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.db")
+	room := newStoredRoom()
+
+	repo := newTestSQLiteRooms(t, path)
+	repo.Add(room)
+	if found := repo.Find(room.ID); !reflect.DeepEqual(found, &room) {
+		t.Fatalf("Expected %+v, got %+v", room, found)
+	}
+
+	// rooms outlive the process
+	repo.Close()
+	reopened := newTestSQLiteRooms(t, path)
+	if found := reopened.Find(room.ID); !reflect.DeepEqual(found, &room) {
+		t.Fatalf("Expected %+v after reopening, got %+v", room, found)
+	}
+	if ids := reopened.IDs(); !reflect.DeepEqual(ids, []string{room.ID}) {
+		t.Fatalf("Expected only %s, got %v", room.ID, ids)
+	}
+
+	reopened.Delete(room.ID)
+	if found := reopened.Find(room.ID); found != nil {
+		t.Fatalf("Expected room to be deleted, got %+v", found)
+	}
+}
+
+func TestSQLiteRoomsRepositoryCompareAndUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.db")
+	room := newStoredRoom()
+
+	repo := newTestSQLiteRooms(t, path)
+	repo.Add(room)
+
+	err := repo.CompareAndUpdate(room.ID, room.Version, func(r *Room) error {
+		r.Stage = StageResults
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected update to succeed, got %s", err.Error())
+	}
+	updated := repo.Find(room.ID)
+	if updated.Stage != StageResults || updated.Version != room.Version+1 {
+		t.Fatalf("Expected stage results at version %d, got %s at %d", room.Version+1, updated.Stage, updated.Version)
+	}
+
+	// the same version again is stale
+	err = repo.CompareAndUpdate(room.ID, room.Version, func(r *Room) error {
+		t.Fatal("Update of a stale version ran")
+		return nil
+	})
+	if !errors.Is(err, ErrRoomVersionConflict) {
+		t.Fatalf("Expected a version conflict, got %v", err)
+	}
+
+	// another process sharing the file updates the room in between
+	other := newTestSQLiteRooms(t, path)
+	err = other.Update(room.ID, func(r *Room) error {
+		r.HostID = "b"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected other update to succeed, got %s", err.Error())
+	}
+	err = repo.CompareAndUpdate(room.ID, updated.Version, func(r *Room) error {
+		r.HostID = "a"
+		return nil
+	})
+	if !errors.Is(err, ErrRoomVersionConflict) {
+		t.Fatalf("Expected a version conflict, got %v", err)
+	}
+	if found := repo.Find(room.ID); found.HostID != "b" {
+		t.Fatalf("Expected the conflicting update to be dropped, host is %s", found.HostID)
+	}
+
+	err = repo.CompareAndUpdate("missing", 0, func(r *Room) error { return nil })
+	if !errors.Is(err, ErrRoomNotFound) {
+		t.Fatalf("Expected missing room, got %v", err)
+	}
+}
+
+func TestSQLiteRoomsRepositoryAddsPresence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.db")
+
+	// players from before presence was tracked
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE players (
+		room_id TEXT NOT NULL,
+		id      TEXT NOT NULL,
+		name    TEXT NOT NULL,
+		ready   INTEGER NOT NULL,
+		PRIMARY KEY (room_id, id)
+	)`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	room := newStoredRoom()
+	repo := newTestSQLiteRooms(t, path)
+	repo.Add(room)
+	if found := repo.Find(room.ID); !reflect.DeepEqual(found, &room) {
+		t.Fatalf("Expected %+v, got %+v", room, found)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const EventTypeUpgradeToken = "upgrade_token"
+
+// EventUpgradeToken hands a connection the token for its next reconnect
+type EventUpgradeToken struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+}
+
+// UpgradeTokens are one-time tokens needed to open a websocket or an SSE
+// stream. Other sites can make a browser connect with its cookies, but
+// they can't read the room page the first token is rendered into.
+//
+// Tokens are signed, not stored: every instance sharing the secret accepts
+// them, before and after a restart. Used tokens are only remembered by the
+// instance they were used with, until they expire.
+type UpgradeTokens struct {
+	secret []byte
+	ttl    time.Duration
+
+	lock *sync.Mutex
+	used map[string]bool
+	// expiries orders used tokens by expiry, to forget them once expired
+	expiries usedTokens
+}
+
+type usedToken struct {
+	token   string
+	expires time.Time
+}
+
+func NewUpgradeTokens(secret []byte, ttl time.Duration) *UpgradeTokens {
+	return &UpgradeTokens{
+		secret: secret,
+		ttl:    ttl,
+		lock:   &sync.Mutex{},
+		used:   make(map[string]bool),
+	}
+}
+
+// NewUpgradeTokenSecret is a random secret, for instances without a
+// configured one
+func NewUpgradeTokenSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// LoadUpgradeTokenSecret reads the secret kept at path, a new one is
+// written there the first time. Instances sharing the file accept each
+// other's tokens, before and after a restart.
+func LoadUpgradeTokenSecret(path string) ([]byte, error) {
+	for {
+		raw, err := os.ReadFile(path)
+		if err == nil {
+			return hex.DecodeString(strings.TrimSpace(string(raw)))
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		// O_EXCL keeps instances starting together from overwriting each
+		// other's secret, the one losing reads the winner's
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		secret, err := NewUpgradeTokenSecret()
+		if err == nil {
+			_, err = f.WriteString(hex.EncodeToString(secret))
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+			return nil, err
+		}
+
+		return secret, nil
+	}
+}
+
+// Issue returns a token clientID can use once to connect to roomID. It's
+// written as "<expiry>.<nonce>.<signature>".
+func (t *UpgradeTokens) Issue(clientID string, roomID string) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(t.ttl).Unix(), 10)
+	payload := expires + "." + hex.EncodeToString(nonce)
+
+	return payload + "." + t.sign(clientID, roomID, payload), nil
+}
+
+// Consume reports whether token was issued to clientID for roomID and
+// hasn't expired. A token is only ever accepted once.
+func (t *UpgradeTokens) Consume(token string, clientID string, roomID string) bool {
+	payload, signature, ok := cutLast(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(t.sign(clientID, roomID, payload))) {
+		return false
+	}
+
+	expiresAt, _, _ := strings.Cut(payload, ".")
+	unix, err := strconv.ParseInt(expiresAt, 10, 64)
+	if err != nil {
+		return false
+	}
+	expires := time.Unix(unix, 0)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	for len(t.expiries) > 0 && now.After(t.expiries[0].expires) {
+		delete(t.used, heap.Pop(&t.expiries).(usedToken).token)
+	}
+
+	if now.After(expires) || t.used[token] {
+		return false
+	}
+	t.used[token] = true
+	heap.Push(&t.expiries, usedToken{token: token, expires: expires})
+
+	return true
+}
+
+func (t *UpgradeTokens) sign(clientID string, roomID string, payload string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	// length prefixes keep fields from running into each other
+	for _, field := range []string{clientID, roomID, payload} {
+		binary.Write(mac, binary.BigEndian, uint32(len(field)))
+		mac.Write([]byte(field))
+	}
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func cutLast(s string, sep string) (before string, after string, found bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+
+	return s[:i], s[i+len(sep):], true
+}
+
+// usedTokens is a heap of used tokens, the first one expires first
+type usedTokens []usedToken
+
+func (h usedTokens) Len() int           { return len(h) }
+func (h usedTokens) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h usedTokens) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *usedTokens) Push(x any) {
+	*h = append(*h, x.(usedToken))
+}
+
+func (h *usedTokens) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return last
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadUpgradeTokenSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upgrade_token.secret")
+
+	secret, err := LoadUpgradeTokenSecret(path)
+	if err != nil {
+		t.Fatalf("Failed to create secret: %s", err.Error())
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Expected the secret to be kept private, got %v, %v", info, err)
+	}
+
+	// a restarted instance picks up the same secret
+	again, err := LoadUpgradeTokenSecret(path)
+	if err != nil {
+		t.Fatalf("Failed to load secret: %s", err.Error())
+	}
+	if !bytes.Equal(secret, again) {
+		t.Fatal("Expected the same secret after a restart")
+	}
+
+	token := issueTestToken(t, NewUpgradeTokens(secret, time.Minute), "client", "room")
+	if !NewUpgradeTokens(again, time.Minute).Consume(token, "client", "room") {
+		t.Fatal("Expected a token from before the restart to be accepted")
+	}
+}
+
+func issueTestToken(t *testing.T, tokens *UpgradeTokens, clientID string, roomID string) string {
+	t.Helper()
+
+	token, err := tokens.Issue(clientID, roomID)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %s", err.Error())
+	}
+
+	return token
+}
+
+func TestUpgradeTokensConsume(t *testing.T) {
+	secret := []byte("secret")
+
+	for _, tc := range []struct {
+		name     string
+		ttl      time.Duration
+		secret   []byte
+		tamper   func(token string) string
+		clientID string
+		roomID   string
+		accepted bool
+	}{
+		{name: "valid", accepted: true},
+		{name: "expired", ttl: -time.Minute},
+		{name: "other client", clientID: "other"},
+		{name: "other room", roomID: "other"},
+		{name: "other secret", secret: []byte("other")},
+		{name: "tampered expiry", tamper: func(token string) string { return "9" + token }},
+		{name: "tampered signature", tamper: func(token string) string {
+			if strings.HasSuffix(token, "A") {
+				return token[:len(token)-1] + "B"
+			}
+			return token[:len(token)-1] + "A"
+		}},
+		{name: "without signature", tamper: func(token string) string {
+			payload, _, _ := cutLast(token, ".")
+			return payload
+		}},
+		{name: "empty", tamper: func(string) string { return "" }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ttl := tc.ttl
+			if ttl == 0 {
+				ttl = time.Minute
+			}
+			token := issueTestToken(t, NewUpgradeTokens(secret, ttl), "client", "room")
+			if tc.tamper != nil {
+				token = tc.tamper(token)
+			}
+			clientID, roomID := "client", "room"
+			if tc.clientID != "" {
+				clientID = tc.clientID
+			}
+			if tc.roomID != "" {
+				roomID = tc.roomID
+			}
+			consumerSecret := secret
+			if tc.secret != nil {
+				consumerSecret = tc.secret
+			}
+
+			tokens := NewUpgradeTokens(consumerSecret, ttl)
+			if accepted := tokens.Consume(token, clientID, roomID); accepted != tc.accepted {
+				t.Fatalf("Expected accepted to be %v, got %v", tc.accepted, accepted)
+			}
+		})
+	}
+}
+
+func TestUpgradeTokensAreUsedOnce(t *testing.T) {
+	tokens := NewUpgradeTokens([]byte("secret"), time.Minute)
+	token := issueTestToken(t, tokens, "client", "room")
+
+	if !tokens.Consume(token, "client", "room") {
+		t.Fatal("Expected the token to be accepted")
+	}
+	if tokens.Consume(token, "client", "room") {
+		t.Fatal("Expected the token to be rejected the second time")
+	}
+	if other := issueTestToken(t, tokens, "client", "room"); !tokens.Consume(other, "client", "room") {
+		t.Fatal("Expected a new token to be accepted")
+	}
+}